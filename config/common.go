@@ -21,6 +21,212 @@
 
 package config
 
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mc0239/logm"
+)
+
+// joinKey appends key to prefixKey, delimited with a dot, unless either of them is empty
+func joinKey(prefixKey string, key string) string {
+	if prefixKey == "" {
+		return key
+	}
+	if key == "" {
+		return prefixKey
+	}
+	return prefixKey + "." + key
+}
+
+// matches list indices at the end of a key segment, i.e. "[0]" in "servers[0]"
+var keyIndicesRegexp = regexp.MustCompile(`^(.*?)((?:\[[0-9]+\])*)$`)
+
+// splitKeyIndices splits a key segment into its name and list indices, i.e. "matrix[1][2]" into
+// "matrix" and [1, 2]
+func splitKeyIndices(segment string) (name string, indices []int) {
+	m := keyIndicesRegexp.FindStringSubmatch(segment)
+	if m[2] == "" {
+		return segment, nil
+	}
+
+	for _, idx := range strings.Split(strings.Trim(m[2], "[]"), "][") {
+		i, _ := strconv.Atoi(idx)
+		indices = append(indices, i)
+	}
+	return m[1], indices
+}
+
+// indexKey returns the key of i-th element of the list under the given key
+func indexKey(key string, i int) string {
+	return fmt.Sprintf("%s[%d]", key, i)
+}
+
+// keyToPath converts a key to a key-value store path, i.e. "servers[0].port" to "servers/[0]/port"
+func keyToPath(key string) string {
+	return strings.Replace(strings.Replace(key, "[", ".[", -1), ".", "/", -1)
+}
+
+// pathToKey converts a key-value store path to a key, i.e. "servers/[0]/port" to "servers[0].port"
+func pathToKey(kvPath string) string {
+	return strings.Replace(strings.Replace(kvPath, "/", ".", -1), ".[", "[", -1)
+}
+
+// hasKeyPrefix reports whether key equals prefix or is nested under it
+func hasKeyPrefix(key string, prefix string) bool {
+	if prefix == "" || key == prefix {
+		return true
+	}
+	return strings.HasPrefix(key, prefix+".") || strings.HasPrefix(key, prefix+"[")
+}
+
+// isKeyOrElement reports whether key is equal to a given key or is one of its list elements (or
+// nested under one), i.e. "routes[0]" or "servers[1].port" for "routes" and "servers"
+func isKeyOrElement(key string, listKey string) bool {
+	return key == listKey || strings.HasPrefix(key, listKey+"[")
+}
+
+// parseKeyPath splits a key into map keys (strings) and list indices (ints), i.e.
+// "servers[0].port" into ["servers", 0, "port"]
+func parseKeyPath(key string) []interface{} {
+	var tokens []interface{}
+	for _, segment := range strings.Split(key, ".") {
+		name, indices := splitKeyIndices(segment)
+		if name != "" {
+			tokens = append(tokens, name)
+		}
+		for _, i := range indices {
+			tokens = append(tokens, i)
+		}
+	}
+	return tokens
+}
+
+// insertValue stores value into a tree of maps and slices at a path given by parseKeyPath and
+// returns the (possibly newly created) node
+func insertValue(node interface{}, tokens []interface{}, value interface{}) interface{} {
+	if len(tokens) == 0 {
+		return value
+	}
+
+	switch token := tokens[0].(type) {
+	case string:
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+		}
+		m[token] = insertValue(m[token], tokens[1:], value)
+		return m
+	case int:
+		list, _ := node.([]interface{})
+		for len(list) <= token {
+			list = append(list, nil)
+		}
+		list[token] = insertValue(list[token], tokens[1:], value)
+		return list
+	}
+	return node
+}
+
+// flattenValue collects keys of all leaf values in a tree of maps and slices, prefixed with key
+func flattenValue(key string, node interface{}, keys []string) []string {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for name, child := range n {
+			keys = flattenValue(joinKey(key, name), child, keys)
+		}
+	case []interface{}:
+		for i, child := range n {
+			keys = flattenValue(indexKey(key, i), child, keys)
+		}
+	case nil:
+	default:
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// countIndices returns the length of a list, given names of its elements' (i.e. "[0]", "[1]").
+// Elements are counted from index 0 up to the first missing index.
+func countIndices(names []string) (int, bool) {
+	present := make(map[int]bool)
+	for _, name := range names {
+		if _, indices := splitKeyIndices(name); len(indices) == 1 && name[0] == '[' {
+			present[indices[0]] = true
+		}
+	}
+
+	n := 0
+	for present[n] {
+		n++
+	}
+	return n, n > 0
+}
+
+// ordinalKey is the key configuration sources can use to override their default ordinal, as
+// defined by MicroProfile Config
+const ordinalKey = "config_ordinal"
+
+// loadOrdinal returns the ordinal a configuration source defines under config_ordinal key, or the
+// default ordinal if key is not defined
+func loadOrdinal(cs ConfigSource, defaultOrdinal int, lgr *logm.Logm) int {
+	val := cs.Get(ordinalKey)
+	if val == nil {
+		return defaultOrdinal
+	}
+
+	ordinal, ok := convertInt(val)
+	if !ok {
+		lgr.Warning("Invalid %s value %v in %s config source, using default ordinal %d",
+			ordinalKey, val, cs.Name(), defaultOrdinal)
+		return defaultOrdinal
+	}
+	return ordinal
+}
+
+// sleepContext pauses for the given duration or until context is done. It reports whether the
+// whole duration has elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// watchState holds the state of a watch on a key-value store between iterations of its loop
+type watchState struct {
+	// waitIndex is the index of the last change received, the next query waits for changes after it
+	waitIndex uint64
+	// retryDelay is the delay in ms before retrying a failed query
+	retryDelay int64
+}
+
+// failed exponentially extends retry delay after a failed query, but keeps it at most maxRetryDelay
+func (s *watchState) failed(maxRetryDelay int64) {
+	s.retryDelay *= 2
+	if s.retryDelay > maxRetryDelay {
+		s.retryDelay = maxRetryDelay
+	}
+}
+
+// succeeded records the index received by a successful query and resets retry delay
+func (s *watchState) succeeded(index uint64, startRetryDelay int64) {
+	s.waitIndex = index
+	s.retryDelay = startRetryDelay
+}
+
 func loadServiceConfiguration(conf Util) (envName, name, version string, startRD, maxRD int64) {
 	if e, ok := conf.GetString("kumuluzee.env.name"); ok {
 		envName = e
@@ -82,3 +288,81 @@ func assertAsNumber(val interface{}) (num float64, ok bool) {
 		return 0, false
 	}
 }
+
+func convertBool(val interface{}) (bool, bool) {
+	if bvalue, ok := val.(bool); ok {
+		return bvalue, true
+	}
+
+	if svalue, ok := val.(string); ok {
+		if bvalue, err := strconv.ParseBool(svalue); err == nil {
+			return bvalue, true
+		}
+	}
+
+	return false, false
+}
+
+func convertInt(val interface{}) (int, bool) {
+	// try to assert as any number type
+	if nvalue, ok := assertAsNumber(val); ok {
+		return int(nvalue), true
+	}
+
+	// try to assert as string and convert to int
+	if svalue, ok := val.(string); ok {
+		if ivalue64, err := strconv.ParseInt(svalue, 0, 64); err == nil {
+			return int(ivalue64), true
+		}
+		if fvalue64, err := strconv.ParseFloat(svalue, 64); err == nil {
+			return int(fvalue64), true
+		}
+	}
+
+	return 0, false
+}
+
+// convertBigInt converts val to an integer of arbitrary size, so that it can be checked against
+// range of any integer type. Floats are truncated, same as with convertInt.
+func convertBigInt(val interface{}) (*big.Int, bool) {
+	switch t := val.(type) {
+	case int, int8, int16, int32, int64:
+		return big.NewInt(reflect.ValueOf(t).Int()), true
+	case uint, uint8, uint16, uint32, uint64:
+		return new(big.Int).SetUint64(reflect.ValueOf(t).Uint()), true
+	case float32, float64:
+		return floatToBigInt(reflect.ValueOf(t).Float())
+	case string:
+		if ivalue, ok := new(big.Int).SetString(t, 0); ok {
+			return ivalue, true
+		}
+		if fvalue64, err := strconv.ParseFloat(t, 64); err == nil {
+			return floatToBigInt(fvalue64)
+		}
+	}
+	return nil, false
+}
+
+func floatToBigInt(f float64) (*big.Int, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, false
+	}
+	ivalue, _ := big.NewFloat(f).Int(nil)
+	return ivalue, true
+}
+
+func convertFloat(val interface{}) (float64, bool) {
+	// try to assert as any number type
+	if nvalue, ok := assertAsNumber(val); ok {
+		return nvalue, true
+	}
+
+	// try to assert as string and convert to float64
+	if svalue, ok := val.(string); ok {
+		if fvalue64, err := strconv.ParseFloat(svalue, 64); err == nil {
+			return fvalue64, true
+		}
+	}
+
+	return 0, false
+}
@@ -23,9 +23,15 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"reflect"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mc0239/logm"
 )
@@ -33,8 +39,22 @@ import (
 // Util is used for retrieving config values from available sources.
 // Util should be initialized with config.NewUtil() function
 type Util struct {
-	configSources []configSource
+	configSources []ConfigSource
+	ordinals      map[string]int
+	prefix        string
+	durationUnit  time.Duration
+	snapshots     bool
+	ctx           context.Context
+	cancel        context.CancelFunc
 	logger        *logm.Logm
+	// scoped is set by Sub, configuration sources of a scoped Util are closed by the original one
+	scoped bool
+}
+
+// Subscription is a watch created with Util.Subscribe or Util.Watch. Watch is stopped by calling
+// Unsubscribe.
+type Subscription struct {
+	cancel context.CancelFunc
 }
 
 // Bundle is used for filling a user-defined struct with config values.
@@ -43,9 +63,41 @@ type Bundle struct {
 	prefixKey string
 	fields    interface{}
 	conf      Util
+	snapshots *bundleSnapshots
+	changes   *bundleChanges
+	cancel    context.CancelFunc
+	ownsConf  bool // conf was created by NewBundle
 	Logger    logm.Logm
 }
 
+// BundleChange describes a change of a Bundle field, applied by a watch.
+type BundleChange struct {
+	// Field is the path of the changed field in fields struct (i.e. "RestConfig.Port")
+	Field string
+	// Key is the configuration key of the field
+	Key string
+	// Old is the value of the field before the change
+	Old interface{}
+	// New is the value of the field after the change
+	New interface{}
+}
+
+// bundleChanges holds hooks and channel that are notified of Bundle changes
+type bundleChanges struct {
+	mu          sync.Mutex
+	hooks       []func(changedFields []string)
+	rejectHooks []func(err *ValidationError)
+	ch          chan BundleChange
+}
+
+// bundleSnapshots holds the latest copy of Bundle's fields struct. Copies are never modified after
+// they have been published, so they can be read concurrently with watched updates.
+type bundleSnapshots struct {
+	// mu serializes updates, readers only load current
+	mu      sync.Mutex
+	current atomic.Value
+}
+
 // Options struct is used when instantiating a new Util or Bundle.
 type Options struct {
 	// ConfigPath is a path to configuration file, including the configuration file name.
@@ -56,17 +108,106 @@ type Options struct {
 	// Additional configuration source's namespace to use (i.e. path prefix). Setting this to a
 	// non-empty value overwrites default namespace or namespace defined in configuration file
 	ExtensionNamespace string
+	// Extensions are additional configuration sources to connect to, which can be used together
+	// (i.e. Consul and etcd). Extension defined with Extension and ExtensionNamespace fields is
+	// used along with these
+	Extensions []Extension
+	// Sources are custom configuration sources, which are used along with built-in configuration
+	// sources and prioritized by their ordinals
+	Sources []ConfigSource
+	// Ordinals overrides ordinals of configuration sources, given by their names (i.e. "env",
+	// "file", "consul", "etcd" or name of a custom source). Ordinals set here take precedence over
+	// ordinals defined by configuration sources themselves under config_ordinal key
+	Ordinals map[string]int
+	// Snapshots enables concurrency-safe Bundles (created with NewBundle, or NewBundleFromUtil with
+	// this Util). Watched changes are not written into fields struct passed to NewBundle, but into
+	// a fresh copy of it, which replaces the previous one atomically and can be retrieved with
+	// Bundle.Current()
+	Snapshots bool
+	// DurationUnit is the unit of durations which are given as bare numbers (i.e. 1500). Passing
+	// zero will default to time.Millisecond
+	DurationUnit time.Duration
 	// LogLevel can be used to limit the amount of logging output. Default log level is 0. Level 4
 	// will only output Warnings and Errors, and level 5 will only output errors.
 	// See package github.com/mc0239/logm for more details on logging and log levels.
 	LogLevel int
 }
 
-type configSource interface {
+// Extension describes an additional configuration source to connect to.
+type Extension struct {
+	// Type of the configuration source. Possible values are: "consul", "etcd"
+	Type string
+	// Hosts is the address of the key-value store. Setting this to a non-empty value overwrites
+	// address defined in configuration file (i.e. kumuluzee.config.consul.hosts)
+	Hosts string
+	// Namespace to use (i.e. path prefix). Setting this to a non-empty value overwrites default
+	// namespace or namespace defined in configuration file
+	Namespace string
+	// Ordinal of the configuration source. Setting this to a non-zero value overwrites default
+	// ordinal (150) or ordinal defined in the key-value store
+	Ordinal int
+}
+
+// ConfigSource is a source of configuration values. Besides built-in configuration sources
+// (environment variables, configuration file, Consul and etcd), custom configuration sources can be
+// registered by passing them in Options.Sources.
+// Configuration sources can optionally implement KeySource, to support key enumeration,
+// PrefixSubscriber, to support watches on prefixes, and io.Closer, to release their resources when
+// Util.Close() is called.
+type ConfigSource interface {
+	// Name returns the name of the configuration source
 	Name() string
-	ordinal() int
+	// Ordinal returns the priority of the configuration source. Values from configuration sources
+	// with higher ordinals override values from configuration sources with lower ordinals
+	Ordinal() int
+	// Get returns the value for a given key, or nil if configuration source does not hold the key
 	Get(key string) interface{}
-	Subscribe(key string, callback func(key string, value string))
+	// Subscribe creates a watch on a given key, firing callback with a ChangeEvent whenever the
+	// value changes, until ctx is done. Configuration sources that do not support watches should
+	// return immediately
+	Subscribe(ctx context.Context, key string, callback func(event ChangeEvent))
+}
+
+// KeySource is implemented by configuration sources that can enumerate keys they hold.
+type KeySource interface {
+	// Keys returns all keys held by the configuration source that are equal to or nested under
+	// prefix
+	Keys(prefix string) []string
+}
+
+// PrefixSubscriber is implemented by configuration sources that can watch all keys under a prefix.
+type PrefixSubscriber interface {
+	// SubscribePrefix creates a watch on all keys that are equal to or nested under prefix, firing
+	// callback with a ChangeEvent whenever a key is added, modified or deleted, until ctx is done
+	SubscribePrefix(ctx context.Context, prefix string, callback func(event ChangeEvent))
+}
+
+// locatingSource is implemented by configuration sources that can report the physical key a value
+// was found under (i.e. environment variable name or key-value store path) and can report failed
+// lookups, instead of returning nil from Get
+type locatingSource interface {
+	locate(key string) (value interface{}, location string, err error)
+}
+
+// listSource is implemented by configuration sources that can report the length of a list stored
+// under a key, so that its elements can be retrieved with index syntax (i.e. key[0])
+type listSource interface {
+	listSize(key string) (int, bool)
+}
+
+// Origin describes where a configuration value was found.
+type Origin struct {
+	// Source is the name of the configuration source that supplied the value
+	Source string
+	// Ordinal is the ordinal number of the configuration source
+	Ordinal int
+	// Key is the physical key the value was stored under: environment variable name for env,
+	// full namespaced path for Consul and etcd, or the dotted key for configuration file
+	Key string
+	// Unavailable holds a *SourceUnavailableError if a configuration source with higher priority
+	// could not be queried (i.e. Consul is down), meaning the value comes from a fallback source
+	// and may be overridden once that source is reachable again. It is nil otherwise.
+	Unavailable error
 }
 
 // NewUtil instantiates a new Util with given options
@@ -74,7 +215,7 @@ func NewUtil(options Options) Util {
 	lgr := logm.New("KumuluzEE-config")
 	lgr.LogLevel = options.LogLevel
 
-	configs := make([]configSource, 0)
+	configs := make([]ConfigSource, 0)
 
 	if envConfigSource := newEnvConfigSource(&lgr); envConfigSource != nil {
 		configs = append(configs, envConfigSource)
@@ -87,36 +228,66 @@ func NewUtil(options Options) Util {
 		lgr.Error("File configuration source failed to load!")
 	}
 
+	for _, cs := range options.Sources {
+		if cs == nil {
+			continue
+		}
+		lgr.Verbose("Adding custom config source %s with ordinal %d", cs.Name(), cs.Ordinal())
+		configs = append(configs, cs)
+	}
+
+	durationUnit := options.DurationUnit
+	if durationUnit == 0 {
+		durationUnit = time.Millisecond
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	k := Util{
-		configs,
-		&lgr,
+		configSources: configs,
+		ordinals:      options.Ordinals,
+		durationUnit:  durationUnit,
+		snapshots:     options.Snapshots,
+		ctx:           ctx,
+		cancel:        cancel,
+		logger:        &lgr,
 	}
 
 	k.sortConfigSources()
 
+	extensions := options.Extensions
+	if options.Extension != "" {
+		extensions = append([]Extension{{
+			Type:      options.Extension,
+			Namespace: options.ExtensionNamespace,
+		}}, extensions...)
+	}
+
 	// use already initialized env/file config util to get values for initialization of extension
-	// config source (consul/etcd)
-	var extConfigSource configSource
-	switch options.Extension {
-	case "consul":
-		extConfigSource = newConsulConfigSource(k, options.ExtensionNamespace, &lgr)
-		break
-	case "etcd":
-		extConfigSource = newEtcdConfigSource(k, options.ExtensionNamespace, &lgr)
-		break
-	case "":
-		// no extension
-		break
-	default:
-		lgr.Error("Invalid extension specified, extension configuration source will not be available")
-		break
-	}
-
-	// if extension config source was successfuly initialized, add it to sources and sort again
-	if extConfigSource != nil {
-		k.configSources = append(k.configSources, extConfigSource)
+	// config sources (consul/etcd)
+	extConfigSources := make([]ConfigSource, 0, len(extensions))
+	for _, ext := range extensions {
+		var extConfigSource ConfigSource
+		switch ext.Type {
+		case "consul":
+			extConfigSource = newConsulConfigSource(k, ext, &lgr)
+			break
+		case "etcd":
+			extConfigSource = newEtcdConfigSource(k, ext, &lgr)
+			break
+		default:
+			lgr.Error("Invalid extension %s specified, extension configuration source will not be available", ext.Type)
+			break
+		}
+
+		if extConfigSource != nil {
+			extConfigSources = append(extConfigSources, extConfigSource)
+		}
 	}
 
+	// if extension config sources were successfuly initialized, add them to sources and sort again
+	k.configSources = append(k.configSources, extConfigSources...)
+
 	k.sortConfigSources()
 
 	return k
@@ -129,65 +300,446 @@ func NewBundle(prefixKey string, fields interface{}, options Options) Bundle {
 
 	util := NewUtil(options)
 
+	bun, err := newBundle(util, prefixKey, fields, lgr)
+	if err != nil {
+		lgr.Error(err.Error())
+	}
+	bun.ownsConf = true
+	return bun
+}
+
+// NewBundleFromUtil fills the given fields struct with values from configuration sources of an
+// existing Util, so that multiple bundles can share configuration sources and their watches.
+// Fields must be a pointer to a struct. If fields is not a struct pointer or some of the fields
+// could not be filled, a *BundleError listing all failures is returned. Fields that could be
+// filled are filled nevertheless.
+// Closing the returned Bundle only stops its watches, util and its configuration sources are left
+// open, since they can be shared with other bundles.
+func NewBundleFromUtil(util Util, prefixKey string, fields interface{}) (Bundle, error) {
+	if util.logger == nil {
+		// Util was not created with NewUtil
+		lgr := logm.New("KumuluzEE-config")
+		util.logger = &lgr
+	}
+	return newBundle(util, prefixKey, fields, *util.logger)
+}
+
+func newBundle(util Util, prefixKey string, fields interface{}, lgr logm.Logm) (Bundle, error) {
+	ctx, cancel := util.watchContext(context.Background())
 	bun := Bundle{
 		prefixKey: prefixKey,
 		fields:    &fields,
 		conf:      util,
+		cancel:    cancel,
 		Logger:    lgr,
 	}
+	if util.snapshots {
+		bun.snapshots = &bundleSnapshots{}
+	}
+	bun.changes = &bundleChanges{}
+
+	if v := reflect.ValueOf(fields); v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return bun, &BundleError{[]error{fmt.Errorf("config: fields must be a non-nil struct pointer, got %T", fields)}}
+	}
 
-	traverseStruct(fields, prefixKey,
+	fieldsType := reflect.TypeOf(fields).Elem()
+
+	var errs []error
+
+	// default values of fields with tag default:"..." are used when no configuration source holds
+	// the key. They are collected from an empty copy of fields struct, which also has all nested
+	// struct pointers allocated.
+	defaults := make(map[string]interface{})
+	traverseStruct(reflect.New(fieldsType).Elem(), prefixKey, allocateAcyclic(fieldsType),
 		func(key string, value reflect.Value, field reflect.StructField, tags reflect.StructTag) {
+			def, ok := tags.Lookup("default")
+			if !ok {
+				return
+			}
+			if value.Kind() != reflect.Slice {
+				defaults[util.fullKey(key)] = def
+				return
+			}
 
-			// fill struct value using util
-			setValueWithReflect(key, value, field, bun)
+			// default value of a list holds comma-separated elements, which are stored under
+			// indexed keys (i.e. key[0]), same as elements of lists in other configuration sources
+			if elemType := value.Type().Elem(); isNestedStruct(elemType) {
+				errs = append(errs, fmt.Errorf("config: default value of field %s of type %s is not supported", key, value.Type()))
+				return
+			}
+			if def == "" {
+				return
+			}
+			for i, elem := range strings.Split(def, ",") {
+				defaults[indexKey(util.fullKey(key), i)] = strings.TrimSpace(elem)
+			}
+		},
+	)
+	if len(defaults) > 0 {
+		bun.conf = withDefaults(util, defaults)
+	}
+
+	var watched []func()
+	// nested struct pointers are only allocated if configuration holds values for them
+	traverseStruct(fields, prefixKey, allocateExisting(bun),
+		func(key string, value reflect.Value, field reflect.StructField, tags reflect.StructTag) {
+
+			// fill struct value using util, checking rules of tag validate:"..."
+			if err := fillField(key, value, field, tags, bun); err != nil {
+				errs = append(errs, err)
+			}
+
+			// report missing fields with tag config:",required"
+			if hasTagOption(tags, "required") {
+				if err := checkRequired(key, value, bun); err != nil {
+					errs = append(errs, err)
+				}
+			}
 
 			// register watch on fields with tag config:",watch"
 
-			if tag, ok := tags.Lookup("config"); ok {
-				tagVals := strings.Split(tag, ",")
-				if len(tagVals) > 1 && tagVals[1] == "watch" {
-					util.Subscribe(key, func(watchKey string, newValue string) {
-						setValueWithReflect(key, value, field, bun)
+			if hasTagOption(tags, "watch") {
+				// watches are registered after fields struct has been filled (and copied)
+				watched = append(watched, func() {
+					bun.conf.SubscribeContext(ctx, key, func(watchKey string, newValue string) {
+						change := BundleChange{Field: fieldPath(fieldsType, field.Index), Key: key}
+						var err error
+						apply := func(value reflect.Value) {
+							change.Old = valueInterface(value)
+							err = fillField(key, value, field, tags, bun)
+							change.New = valueInterface(value)
+						}
+						if bun.snapshots != nil {
+							bun.snapshots.update(func(fields reflect.Value) {
+								apply(fieldByIndexCopy(fields, field.Index))
+							})
+						} else {
+							apply(value)
+						}
+						if verr, ok := err.(*ValidationError); ok {
+							lgr.Warning("Watched value %s rejected: %s", key, err.Error())
+							bun.changes.reject(verr)
+							return
+						}
+						if err != nil {
+							lgr.Warning("Watched value %s could not be updated: %s", key, err.Error())
+							return
+						}
 						//value.Set(reflect.ValueOf(newValue))
 						lgr.Verbose("Watched value %s updated, new value: %s", key, newValue)
+
+						if !reflect.DeepEqual(change.Old, change.New) {
+							bun.changes.notify(change, lgr)
+						}
 					})
-				}
+				})
 			}
 
 		},
 	)
 
-	return bun
+	if bun.snapshots != nil {
+		bun.snapshots.current.Store(copyStruct(reflect.ValueOf(fields)).Interface())
+	}
+	for _, watch := range watched {
+		watch()
+	}
+
+	if len(errs) > 0 {
+		return bun, &BundleError{errs}
+	}
+	return bun, nil
+}
+
+// Close stops all watches of Bundle. If Bundle was created with NewBundle, configuration sources of
+// its Util are closed as well (see Util.Close).
+func (b Bundle) Close() error {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	if b.ownsConf {
+		return b.conf.Close()
+	}
+	return nil
+}
+
+// Current returns the latest snapshot of fields struct, as a pointer of the same type as fields
+// passed to NewBundle (i.e. bun.Current().(*myConfig)), if Bundle was created with Snapshots
+// option. Snapshots are never modified, watched changes are published as new snapshots, so they
+// are safe to read concurrently with updates.
+// Without Snapshots option, fields passed to NewBundle are returned.
+func (b Bundle) Current() interface{} {
+	if b.snapshots != nil {
+		return b.snapshots.current.Load()
+	}
+	return *b.fields.(*interface{})
+}
+
+// OnChange registers a hook, which is called with paths of changed fields (i.e. "RestConfig.Port")
+// whenever watched changes are applied to Bundle. Hooks are called from watch goroutines, after
+// the change has been applied.
+func (b Bundle) OnChange(hook func(changedFields []string)) {
+	b.changes.mu.Lock()
+	defer b.changes.mu.Unlock()
+	b.changes.hooks = append(b.changes.hooks, hook)
+}
+
+// OnReject registers a hook, which is called whenever a watched change is rejected because the new
+// value violates rules of field's validate tag. Rejected changes are not applied, field keeps its
+// previous value.
+func (b Bundle) OnReject(hook func(err *ValidationError)) {
+	b.changes.mu.Lock()
+	defer b.changes.mu.Unlock()
+	b.changes.rejectHooks = append(b.changes.rejectHooks, hook)
+}
+
+// Changes returns a channel, which receives a BundleChange for every watched change applied to
+// Bundle. The channel is buffered; if it is not drained, further changes are dropped (and logged)
+// until there is room in the buffer again.
+func (b Bundle) Changes() <-chan BundleChange {
+	b.changes.mu.Lock()
+	defer b.changes.mu.Unlock()
+	if b.changes.ch == nil {
+		b.changes.ch = make(chan BundleChange, 100)
+	}
+	return b.changes.ch
 }
 
-// Subscribe creates a watch on a given configuration key.
-// Note that watch will be enabled on an extension configuration source, if one has been defined
-// when Util was created.
-// When value in configuration updates, callback is fired with the key and the new value.
-func (c Util) Subscribe(key string, callback func(key string, value string)) {
+// notify calls hooks and sends a change to the channel, if it has been requested
+func (c *bundleChanges) notify(change BundleChange, lgr logm.Logm) {
+	c.mu.Lock()
+	hooks := c.hooks
+	ch := c.ch
+	c.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook([]string{change.Field})
+	}
+	if ch != nil {
+		select {
+		case ch <- change:
+		default:
+			lgr.Warning("Changes channel of bundle is full, change of %s dropped", change.Field)
+		}
+	}
+}
+
+// reject calls hooks registered with OnReject
+func (c *bundleChanges) reject(err *ValidationError) {
+	c.mu.Lock()
+	hooks := c.rejectHooks
+	c.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(err)
+	}
+}
+
+// update publishes a copy of the current snapshot, modified by apply
+func (s *bundleSnapshots) update(apply func(fields reflect.Value)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := copyStruct(reflect.ValueOf(s.current.Load()))
+	apply(next.Elem())
+	s.current.Store(next.Interface())
+}
+
+// Subscribe creates a watch on a given configuration key. Watches are supported by configuration
+// file, Consul and etcd, as well as custom configuration sources that implement Subscribe.
+// When the value of the key (as returned by Util.Get) changes, callback is fired with the key and
+// the new value (empty if key was deleted). Use Util.Watch to tell deleted keys apart from empty
+// values. If key holds a list, changes of its elements are reported with their keys (i.e.
+// key[0]). Changes in configuration sources that are overridden by configuration sources with
+// higher priority do not fire callback.
+// Watch runs until Unsubscribe is called on the returned Subscription or Util is closed.
+func (c Util) Subscribe(key string, callback func(key string, value string)) Subscription {
+	return c.SubscribeContext(context.Background(), key, callback)
+}
+
+// SubscribeContext creates a watch on a given configuration key, same as Util.Subscribe, but the
+// watch is also stopped when ctx is done.
+func (c Util) SubscribeContext(ctx context.Context, key string, callback func(key string, value string)) Subscription {
+	return c.WatchContext(ctx, key, func(event ChangeEvent) {
+		callback(event.Key, valueString(event.NewValue))
+	})
+}
+
+// SubscribePrefix creates a watch on all keys that are equal to or nested under a given prefix.
+// Callback is fired with the changed key and its new value whenever a key is added, modified or
+// deleted (deleted keys have an empty value). Watches on prefixes are supported by configuration
+// file, Consul and etcd, as well as custom configuration sources that implement PrefixSubscriber.
+// Watch runs until Unsubscribe is called on the returned Subscription or Util is closed.
+func (c Util) SubscribePrefix(prefix string, callback func(key string, value string)) Subscription {
+	return c.SubscribePrefixContext(context.Background(), prefix, callback)
+}
+
+// SubscribePrefixContext creates a watch on a given prefix, same as Util.SubscribePrefix, but the
+// watch is also stopped when ctx is done.
+func (c Util) SubscribePrefixContext(ctx context.Context, prefix string, callback func(key string, value string)) Subscription {
+	return c.WatchPrefixContext(ctx, prefix, func(event ChangeEvent) {
+		callback(event.Key, valueString(event.NewValue))
+	})
+}
+
+// Watch creates a watch on a given configuration key, same as Util.Subscribe, but callback is
+// fired with a ChangeEvent, which holds the old and the new value, type of the change and the
+// configuration source that supplies the new value. Keys of events are relative to Util's prefix
+// (see Util.Sub), same as keys passed to Watch.
+func (c Util) Watch(key string, callback func(event ChangeEvent)) Subscription {
+	return c.WatchContext(context.Background(), key, callback)
+}
+
+// WatchContext creates a watch on a given configuration key, same as Util.Watch, but the watch is
+// also stopped when ctx is done.
+func (c Util) WatchContext(ctx context.Context, key string, callback func(event ChangeEvent)) Subscription {
+	key = c.fullKey(key)
+
+	ctx, cancel := c.watchContext(ctx)
+	callback = c.relativeEvents(callback)
+	keys := []string{key}
+	for _, k := range c.keys(key) {
+		if k != key && isKeyOrElement(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	w := newEffectiveWatch(c, keys, callback)
+
+	// deploy a watch on every ConfigSource, sources that do not support watches return immediately
+	for _, cs := range c.configSources {
+		cs.Subscribe(ctx, key, w.changed)
+	}
+
+	return Subscription{cancel}
+}
+
+// WatchPrefix creates a watch on all keys that are equal to or nested under a given prefix, same
+// as Util.SubscribePrefix, but callback is fired with a ChangeEvent.
+func (c Util) WatchPrefix(prefix string, callback func(event ChangeEvent)) Subscription {
+	return c.WatchPrefixContext(context.Background(), prefix, callback)
+}
+
+// WatchPrefixContext creates a watch on a given prefix, same as Util.WatchPrefix, but the watch is
+// also stopped when ctx is done.
+func (c Util) WatchPrefixContext(ctx context.Context, prefix string, callback func(event ChangeEvent)) Subscription {
+	prefix = c.fullKey(prefix)
+
+	ctx, cancel := c.watchContext(ctx)
+	w := newEffectiveWatch(c, c.keys(prefix), c.relativeEvents(callback))
 
-	// find extension configSource and deploy a watch
 	for _, cs := range c.configSources {
-		cs.Subscribe(key, callback)
+		if ps, ok := cs.(PrefixSubscriber); ok {
+			ps.SubscribePrefix(ctx, prefix, w.changed)
+		}
 	}
 
+	return Subscription{cancel}
+}
+
+// relativeEvents wraps a watch callback, so that it receives keys relative to Util's prefix (i.e.
+// "port" instead of "rest.port" for Sub("rest")), same as keys passed to Util's methods
+func (c Util) relativeEvents(callback func(event ChangeEvent)) func(event ChangeEvent) {
+	if c.prefix == "" {
+		return callback
+	}
+	return func(event ChangeEvent) {
+		event.Key = strings.TrimPrefix(strings.TrimPrefix(event.Key, c.prefix), ".")
+		callback(event)
+	}
+}
+
+// Unsubscribe stops the watch. It is safe to call Unsubscribe multiple times.
+func (s Subscription) Unsubscribe() {
+	if s.cancel != nil {
+		s.cancel()
+	}
 }
 
 // Get returns the value for a given key, stored in configuration.
 // Configuration sources are checked by their ordinal numbers, and value is returned from first
 // configuration source it was found in.
 func (c Util) Get(key string) interface{} {
-	// iterate through configSources and try to get some value ...
-	var val interface{}
+	val, _, _ := c.lookup(key)
+	return val
+}
 
-	for _, cs := range c.configSources {
-		val = cs.Get(key)
-		if val != nil {
-			break
+// Keys returns all keys that are equal to or nested under a given prefix, collected from all
+// configuration sources. Pass an empty prefix to list all keys.
+// Keys of environment variables are derived from variable names (i.e. REST_CONFIG_PORT maps to
+// rest-config.port if that key exists in another configuration source, otherwise to
+// rest.config.port). With an empty prefix, only environment variables that map to keys from other
+// configuration sources are listed, so that unrelated variables of the process are left out.
+func (c Util) Keys(prefix string) []string {
+	keys := c.keys(c.fullKey(prefix))
+	if c.prefix != "" {
+		// return keys relative to Util's prefix
+		relKeys := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if relKey := strings.TrimPrefix(key, c.prefix+"."); relKey != key {
+				relKeys = append(relKeys, relKey)
+			} else if strings.HasPrefix(key, c.prefix+"[") {
+				relKeys = append(relKeys, strings.TrimPrefix(key, c.prefix))
+			}
 		}
+		return relKeys
 	}
-	return val
+	return keys
+}
+
+// GetMap returns all values stored under a given prefix, as a nested map. Lists are stored as
+// slices. Keys are collected from all configuration sources, and every value is resolved with
+// Util.Get(), meaning that values are taken from the configuration source with highest priority
+// that holds them.
+// If there are no keys under prefix or prefix holds a list, nil is returned with ok equal to false.
+func (c Util) GetMap(prefix string) (value map[string]interface{}, ok bool) {
+	fullPrefix := c.fullKey(prefix)
+	var tree interface{}
+
+	for _, key := range c.keys(fullPrefix) {
+		relKey := strings.TrimPrefix(strings.TrimPrefix(key, fullPrefix), ".")
+		if relKey == "" {
+			// value is stored directly under prefix
+			continue
+		}
+		if val := c.Get(joinKey(prefix, relKey)); val != nil {
+			tree = insertValue(tree, parseKeyPath(relKey), val)
+		}
+	}
+
+	// prefix could also hold a list
+	value, ok = tree.(map[string]interface{})
+	return value, ok
+}
+
+// Sub returns a Util scoped to a given prefix: keys passed to its methods are resolved relative to
+// the prefix, i.e. Sub("rest-config").Get("port") returns value of "rest-config.port".
+// Returned Util shares configuration sources with the original one, so calling Close on it does
+// nothing: its watches are stopped by Unsubscribe or by closing the original Util.
+func (c Util) Sub(prefix string) Util {
+	sub := c
+	sub.prefix = c.fullKey(prefix)
+	sub.scoped = true
+	return sub
+}
+
+// GetWithSource behaves like Util.Get, but also returns the origin of the value, i.e. which
+// configuration source supplied it and under which physical key. If a configuration source with
+// higher priority could not be queried, its error is held in origin.Unavailable.
+// If value is not found in any configuration source, ok is equal to false.
+func (c Util) GetWithSource(key string) (value interface{}, origin Origin, ok bool) {
+	val, origin, err := c.lookup(key)
+	return val, origin, err == nil
+}
+
+// GetE behaves like Util.Get, but returns an error describing why the value could not be
+// retrieved. If key is not found, a *KeyNotFoundError is returned, unless one of the configuration
+// sources could not be queried, in which case a *SourceUnavailableError is returned.
+// Note that if a configuration source could not be queried, but a source with lower priority holds
+// the key, that value is returned without an error (and the failure is logged). Use
+// Util.GetWithSource to detect such fallbacks.
+func (c Util) GetE(key string) (interface{}, error) {
+	val, _, err := c.lookup(key)
+	return val, err
 }
 
 // GetBool is a helper method that calls Util.Get() internally and type asserts the value to
@@ -195,22 +747,22 @@ func (c Util) Get(key string) interface{} {
 // If value is not found in any configuration source or the value could not be type asserted to
 // bool, a false is returned with ok equal to false.
 func (c Util) GetBool(key string) (value bool, ok bool) {
-	rvalue := c.Get(key)
+	value, err := c.GetBoolE(key)
+	return value, err == nil
+}
 
-	bvalue, ok := c.Get(key).(bool)
-	if ok {
-		return bvalue, true
+// GetBoolE is a variant of Util.GetBool that returns an error instead of ok flag. If value could
+// not be converted to bool, a *TypeMismatchError is returned.
+func (c Util) GetBoolE(key string) (bool, error) {
+	rvalue, origin, err := c.lookup(key)
+	if err != nil {
+		return false, err
 	}
 
-	svalue, ok := rvalue.(string)
-	if ok {
-		bvalue, err := strconv.ParseBool(string(svalue))
-		if err == nil {
-			return bvalue, true
-		}
+	if bvalue, ok := convertBool(rvalue); ok {
+		return bvalue, nil
 	}
-
-	return false, false
+	return false, &TypeMismatchError{c.fullKey(key), origin.Source, rvalue, "bool"}
 }
 
 // GetInt is a helper method that calls Util.Get() internally and type asserts the value to
@@ -218,28 +770,22 @@ func (c Util) GetBool(key string) (value bool, ok bool) {
 // If value is not found in any configuration source or the value could not be type asserted to
 // int, a zero is returned with ok equal to false.
 func (c Util) GetInt(key string) (value int, ok bool) {
-	rvalue := c.Get(key)
+	value, err := c.GetIntE(key)
+	return value, err == nil
+}
 
-	// try to assert as any number type
-	nvalue, ok := assertAsNumber(rvalue)
-	if ok {
-		return int(nvalue), true
+// GetIntE is a variant of Util.GetInt that returns an error instead of ok flag. If value could
+// not be converted to int, a *TypeMismatchError is returned.
+func (c Util) GetIntE(key string) (int, error) {
+	rvalue, origin, err := c.lookup(key)
+	if err != nil {
+		return 0, err
 	}
 
-	// try to assert as string and convert to int
-	svalue, ok := rvalue.(string)
-	if ok {
-		ivalue64, err := strconv.ParseInt(svalue, 0, 64)
-		if err == nil {
-			return int(ivalue64), true
-		}
-		fvalue64, err := strconv.ParseFloat(svalue, 64)
-		if err == nil {
-			return int(fvalue64), true
-		}
+	if ivalue, ok := convertInt(rvalue); ok {
+		return ivalue, nil
 	}
-
-	return 0, false
+	return 0, &TypeMismatchError{c.fullKey(key), origin.Source, rvalue, "int"}
 }
 
 // GetFloat is a helper method that calls Util.Get() internally and type asserts the value to
@@ -247,24 +793,22 @@ func (c Util) GetInt(key string) (value int, ok bool) {
 // If value is not found in any configuration source or the value could not be type asserted to
 // float64, a zero is returned with ok equal to false.
 func (c Util) GetFloat(key string) (value float64, ok bool) {
-	rvalue := c.Get(key)
+	value, err := c.GetFloatE(key)
+	return value, err == nil
+}
 
-	// try to assert as any number type
-	nvalue, ok := assertAsNumber(rvalue)
-	if ok {
-		return nvalue, true
+// GetFloatE is a variant of Util.GetFloat that returns an error instead of ok flag. If value could
+// not be converted to float64, a *TypeMismatchError is returned.
+func (c Util) GetFloatE(key string) (float64, error) {
+	rvalue, origin, err := c.lookup(key)
+	if err != nil {
+		return 0, err
 	}
 
-	// try to assert as string and convert to float64
-	svalue, ok := rvalue.(string)
-	if ok {
-		fvalue64, err := strconv.ParseFloat(svalue, 64)
-		if err == nil {
-			return fvalue64, true
-		}
+	if fvalue, ok := convertFloat(rvalue); ok {
+		return fvalue, nil
 	}
-
-	return 0, false
+	return 0, &TypeMismatchError{c.fullKey(key), origin.Source, rvalue, "float64"}
 }
 
 // GetString is a helper method that calls Util.Get() internally and type asserts the value to
@@ -272,25 +816,267 @@ func (c Util) GetFloat(key string) (value float64, ok bool) {
 // If value is not found in any configuration source or the value could not be type asserted to
 // string, an empty string is returned with ok equal to false.
 func (c Util) GetString(key string) (value string, ok bool) {
-	// try to type assert as string
-	svalue, ok := c.Get(key).(string)
-	if ok {
-		return svalue, true
+	value, err := c.GetStringE(key)
+	return value, err == nil
+}
+
+// GetStringE is a variant of Util.GetString that returns an error instead of ok flag. If value is
+// not a string, a *TypeMismatchError is returned.
+func (c Util) GetStringE(key string) (string, error) {
+	rvalue, origin, err := c.lookup(key)
+	if err != nil {
+		return "", err
 	}
 
-	// can't assert to string, return nil
-	return "", false
+	if svalue, ok := rvalue.(string); ok {
+		return svalue, nil
+	}
+	return "", &TypeMismatchError{c.fullKey(key), origin.Source, rvalue, "string"}
 }
 
-// sort config sources by ordinal numbers
-func (c Util) sortConfigSources() {
-	// insertion sort
-	for i := 1; i < len(c.configSources); i++ {
-		for k := i; k > 0 && c.configSources[k].ordinal() > c.configSources[k-1].ordinal(); k-- {
-			// swap
-			temp := c.configSources[k]
-			c.configSources[k] = c.configSources[k-1]
-			c.configSources[k-1] = temp
+// GetDuration is a helper method that calls Util.Get() internally and converts the value to
+// time.Duration before returning it. Go duration strings (i.e. "1m30s"), ISO-8601 durations (i.e.
+// "PT1M30S") and bare numbers, which are interpreted in unit given by Options.DurationUnit, are
+// accepted.
+// If value is not found in any configuration source or the value could not be converted to
+// time.Duration, a zero is returned with ok equal to false.
+func (c Util) GetDuration(key string) (value time.Duration, ok bool) {
+	value, err := c.GetDurationE(key)
+	return value, err == nil
+}
+
+// GetDurationE is a variant of Util.GetDuration that returns an error instead of ok flag. If value
+// could not be converted to time.Duration, a *TypeMismatchError is returned.
+func (c Util) GetDurationE(key string) (time.Duration, error) {
+	rvalue, origin, err := c.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if dvalue, ok := convertDuration(rvalue, c.durationUnit); ok {
+		return dvalue, nil
+	}
+	return 0, &TypeMismatchError{c.fullKey(key), origin.Source, rvalue, "time.Duration"}
+}
+
+// GetListSize returns the number of elements of a list stored under a given key. Elements can be
+// retrieved using index syntax, i.e. key[0], or key[0].sub for lists of objects.
+// Since every element can be overridden by a configuration source with higher priority, list size
+// is the largest size of the list among all configuration sources that hold it (i.e. environment
+// variable KEY_0 overrides only the first element of a longer list in configuration file).
+func (c Util) GetListSize(key string) (size int, ok bool) {
+	key = c.fullKey(key)
+	for _, cs := range c.configSources {
+		if csSize, found := configSourceListSize(cs, key); found {
+			if csSize > size {
+				size = csSize
+			}
+			ok = true
+		}
+	}
+	return size, ok
+}
+
+// configSourceListSize returns the number of elements of a list stored under a given key in a
+// single configuration source
+func configSourceListSize(cs ConfigSource, key string) (size int, ok bool) {
+	if lcs, isList := cs.(listSource); isList {
+		return lcs.listSize(key)
+	}
+
+	// custom sources can hold the list as a slice or its elements under indexed keys
+	if list, isList := cs.Get(key).([]interface{}); isList {
+		return len(list), true
+	}
+	for cs.Get(indexKey(key, size)) != nil {
+		size++
+	}
+	return size, size > 0
+}
+
+// GetStringSlice is a helper method that retrieves all elements of a list under a given key as
+// strings. Elements are retrieved with Util.GetString() using index syntax (i.e. key[0]), so every
+// element can be overridden by a configuration source with higher priority.
+// If list is not found in any configuration source or any of its elements could not be type
+// asserted to string, nil is returned with ok equal to false.
+func (c Util) GetStringSlice(key string) (value []string, ok bool) {
+	size, ok := c.GetListSize(key)
+	if !ok {
+		return nil, false
+	}
+
+	value = make([]string, size)
+	for i := range value {
+		if value[i], ok = c.GetString(indexKey(key, i)); !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// GetIntSlice is a helper method that retrieves all elements of a list under a given key as ints.
+// Elements are retrieved with Util.GetInt() using index syntax (i.e. key[0]), so every element can
+// be overridden by a configuration source with higher priority.
+// If list is not found in any configuration source or any of its elements could not be type
+// asserted to int, nil is returned with ok equal to false.
+func (c Util) GetIntSlice(key string) (value []int, ok bool) {
+	size, ok := c.GetListSize(key)
+	if !ok {
+		return nil, false
+	}
+
+	value = make([]int, size)
+	for i := range value {
+		if value[i], ok = c.GetInt(indexKey(key, i)); !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// lookup iterates through configSources by priority and returns the first value found for a key
+// (relative to Util's prefix), along with its origin. If a source implements locatingSource, its
+// errors are logged and remembered. They are reported as error only if none of the sources holds
+// the key, otherwise they are reported in Origin.Unavailable.
+func (c Util) lookup(key string) (interface{}, Origin, error) {
+	key = c.fullKey(key)
+	var unavailable error
+	names := make([]string, 0, len(c.configSources))
+
+	for _, cs := range c.configSources {
+		// default values of Bundle fields are not a configuration source users could set a key in
+		if _, isDefault := cs.(defaultsConfigSource); !isDefault {
+			names = append(names, cs.Name())
+		}
+
+		var val interface{}
+		location := key
+		if lcs, ok := cs.(locatingSource); ok {
+			var err error
+			val, location, err = lcs.locate(key)
+			if err != nil {
+				if c.logger != nil {
+					c.logger.Warning("Error getting value of key %s from source %s: %v", key, cs.Name(), err)
+				}
+				if unavailable == nil {
+					unavailable = &SourceUnavailableError{key, cs.Name(), err}
+				}
+				continue
+			}
+		} else {
+			val = cs.Get(key)
+		}
+
+		if val != nil {
+			return val, Origin{cs.Name(), c.ordinalOf(cs), location, unavailable}, nil
 		}
 	}
+
+	if unavailable != nil {
+		return nil, Origin{}, unavailable
+	}
+	return nil, Origin{}, &KeyNotFoundError{key, names}
+}
+
+// keys returns a sorted union of keys under a given (absolute) prefix, held by configSources.
+// Keys of environment variables are matched against keys of other sources, since they can not be
+// mapped back to keys unambiguously.
+func (c Util) keys(prefix string) []string {
+	set := make(map[string]bool)
+	var envKeys []string
+
+	for _, cs := range c.configSources {
+		kcs, ok := cs.(KeySource)
+		if !ok {
+			continue
+		}
+		if _, isEnv := cs.(envConfigSource); isEnv {
+			envKeys = append(envKeys, kcs.Keys(prefix)...)
+			continue
+		}
+		for _, key := range kcs.Keys(prefix) {
+			set[key] = true
+		}
+	}
+	// without a prefix, only environment variables that map to keys from other configuration
+	// sources are listed, rather than the whole environment of the process
+	for _, key := range matchEnvKeys(envKeys, set, prefix == "") {
+		set[key] = true
+	}
+
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// watchContext returns a context for a new watch, which is done when either ctx is done or Util is
+// closed
+func (c Util) watchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if c.ctx != nil {
+		go func() {
+			select {
+			case <-c.ctx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// fullKey returns the absolute key for a key relative to Util's prefix
+func (c Util) fullKey(key string) string {
+	return joinKey(c.prefix, key)
+}
+
+// Close stops all watches created with Util.Subscribe and releases resources held by configuration
+// sources (i.e. connections to Consul and etcd, or resources of sources that implement io.Closer).
+// Util should not be used after it has been closed.
+// Close does nothing on a Util returned by Util.Sub, since it shares configuration sources with the
+// original Util.
+func (c Util) Close() error {
+	if c.scoped {
+		return nil
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	var firstErr error
+	for _, cs := range c.configSources {
+		if closer, ok := cs.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				c.logger.Warning("Failed to close %s config source: %s", cs.Name(), err.Error())
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+// ordinalOf returns the ordinal of a configuration source, taking overrides from Options.Ordinals
+// into account
+func (c Util) ordinalOf(cs ConfigSource) int {
+	if ordinal, ok := c.ordinals[cs.Name()]; ok {
+		return ordinal
+	}
+	return cs.Ordinal()
+}
+
+// sort config sources by ordinal numbers, configuration sources with equal ordinals are sorted by
+// their names
+func (c Util) sortConfigSources() {
+	sort.SliceStable(c.configSources, func(i, j int) bool {
+		oi, oj := c.ordinalOf(c.configSources[i]), c.ordinalOf(c.configSources[j])
+		if oi != oj {
+			return oi > oj
+		}
+		return c.configSources[i].Name() < c.configSources[j].Name()
+	})
 }
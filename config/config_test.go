@@ -0,0 +1,1064 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mapConfigSource struct {
+	values  map[string]interface{}
+	ordinal int
+	closed  *bool
+}
+
+func (c mapConfigSource) Name() string {
+	return "map"
+}
+
+func (c mapConfigSource) Ordinal() int {
+	return c.ordinal
+}
+
+func (c mapConfigSource) Get(key string) interface{} {
+	return c.values[key]
+}
+
+func (c mapConfigSource) Subscribe(ctx context.Context, key string, callback func(event ChangeEvent)) {
+}
+
+func (c mapConfigSource) Keys(prefix string) []string {
+	var keys []string
+	for key := range c.values {
+		if hasKeyPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (c mapConfigSource) Close() error {
+	*c.closed = true
+	return nil
+}
+
+func configAssert(t *testing.T, expected interface{}, got interface{}) {
+	if expected != got {
+		t.Errorf("expected=%v, got=%v", expected, got)
+	}
+}
+
+func TestCustomConfigSource(t *testing.T) {
+	closed := false
+	source := mapConfigSource{
+		values: map[string]interface{}{
+			"some-config.protocol": "udp",
+			"some-config.timeout":  30,
+			"custom-list[0]":       "a",
+			"custom-list[1]":       "b",
+		},
+		ordinal: 200,
+		closed:  &closed,
+	}
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+
+	// custom source overrides file, but not env
+	configAssert(t, "env,map,file", sourceNames(c))
+
+	s, ok := c.GetString("some-config.protocol")
+	configAssert(t, true, ok)
+	configAssert(t, "udp", s)
+
+	i, ok := c.GetInt("some-config.timeout")
+	configAssert(t, true, ok)
+	configAssert(t, 30, i)
+
+	l, ok := c.GetStringSlice("custom-list")
+	configAssert(t, true, ok)
+	configAssert(t, 2, len(l))
+
+	keys := c.Keys("some-config")
+	configAssert(t, 6, len(keys))
+
+	configAssert(t, nil, c.Close())
+	configAssert(t, true, closed)
+}
+
+func sourceNames(c Util) string {
+	names := make([]string, 0)
+	for _, cs := range c.configSources {
+		names = append(names, cs.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func TestConfigOrdinal(t *testing.T) {
+	os.Setenv("SOME_CONFIG_PROTOCOL", "udp")
+	defer os.Unsetenv("SOME_CONFIG_PROTOCOL")
+
+	// file defines config_ordinal: 400, overriding env
+	c := NewUtil(Options{
+		ConfigPath: "../test/config-ordinal.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	configAssert(t, "file,env", sourceNames(c))
+	s, origin, _ := c.GetWithSource("some-config.protocol")
+	configAssert(t, "tcp", s)
+	configAssert(t, 400, origin.Ordinal)
+
+	// programmatic override takes precedence over config_ordinal
+	c = NewUtil(Options{
+		ConfigPath: "../test/config-ordinal.yaml",
+		Ordinals:   map[string]int{"file": 50},
+		LogLevel:   100, // turn off logging
+	})
+	configAssert(t, "env,file", sourceNames(c))
+	s, origin, _ = c.GetWithSource("some-config.protocol")
+	configAssert(t, "udp", s)
+	configAssert(t, 300, origin.Ordinal)
+
+	// env defines its own ordinal with CONFIG_ORDINAL variable
+	os.Setenv("CONFIG_ORDINAL", "50")
+	defer os.Unsetenv("CONFIG_ORDINAL")
+	c = NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	configAssert(t, "file,env", sourceNames(c))
+}
+
+func TestConfigOrdinalTieBreak(t *testing.T) {
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources: []ConfigSource{
+			namedConfigSource{mapConfigSource{ordinal: 100}, "zzz"},
+			namedConfigSource{mapConfigSource{ordinal: 100}, "aaa"},
+		},
+		LogLevel: 100, // turn off logging
+	})
+	configAssert(t, "env,aaa,file,zzz", sourceNames(c))
+}
+
+type namedConfigSource struct {
+	mapConfigSource
+	name string
+}
+
+func (c namedConfigSource) Name() string {
+	return c.name
+}
+
+func TestMultipleExtensions(t *testing.T) {
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Extensions: []Extension{
+			{Type: "consul", Hosts: "http://127.0.0.1:1", Namespace: "consul-ns", Ordinal: 160},
+			{Type: "etcd", Hosts: "http://127.0.0.1:1", Namespace: "etcd-ns"},
+		},
+		LogLevel: 100, // turn off logging
+	})
+	configAssert(t, "env,consul,etcd,file", sourceNames(c))
+
+	consul := c.configSources[1].(consulConfigSource)
+	configAssert(t, "consul-ns", consul.namespace)
+	configAssert(t, 160, consul.Ordinal())
+
+	etcd := c.configSources[2].(etcdConfigSource)
+	configAssert(t, "etcd-ns", etcd.namespace)
+	configAssert(t, 150, etcd.Ordinal())
+
+	// values from file are still available, although extensions are not
+	s, ok := c.GetString("some-config.protocol")
+	configAssert(t, true, ok)
+	configAssert(t, "tcp", s)
+}
+
+// stoppableConfigSource reports on stopped channel when a watch is stopped
+type stoppableConfigSource struct {
+	mapConfigSource
+	stopped chan string
+}
+
+func (c stoppableConfigSource) Subscribe(ctx context.Context, key string, callback func(event ChangeEvent)) {
+	go func() {
+		<-ctx.Done()
+		c.stopped <- key
+	}()
+}
+
+func TestSubscriptionCancel(t *testing.T) {
+	closed := false
+	source := stoppableConfigSource{mapConfigSource{closed: &closed}, make(chan string, 3)}
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+
+	expectStopped := func(expected string) {
+		select {
+		case key := <-source.stopped:
+			configAssert(t, expected, key)
+		case <-time.After(time.Second):
+			t.Errorf("watch on %s was not stopped", expected)
+		}
+	}
+
+	sub := c.Subscribe("key-1", func(key string, value string) {})
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	expectStopped("key-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.SubscribeContext(ctx, "key-2", func(key string, value string) {})
+	cancel()
+	expectStopped("key-2")
+
+	// closing a scoped Util neither stops watches nor closes sources of the original one
+	c.Sub("prefix").Subscribe("key-3", func(key string, value string) {})
+	c.Sub("prefix").Close()
+	select {
+	case key := <-source.stopped:
+		t.Errorf("watch on %s was stopped by a scoped Util", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+	configAssert(t, false, closed)
+
+	c.Close()
+	expectStopped("prefix.key-3")
+	configAssert(t, true, closed)
+}
+
+func TestBundleClose(t *testing.T) {
+	type watchedConfig struct {
+		Key string `config:"key,watch"`
+	}
+
+	closed := false
+	source := stoppableConfigSource{mapConfigSource{closed: &closed}, make(chan string, 3)}
+	options := Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	}
+
+	expectStopped := func(expected string) {
+		select {
+		case key := <-source.stopped:
+			configAssert(t, expected, key)
+		case <-time.After(time.Second):
+			t.Errorf("watch on %s was not stopped", expected)
+		}
+	}
+
+	// bundle created from a Util only stops its own watches
+	c := NewUtil(options)
+	var shared watchedConfig
+	bun, _ := NewBundleFromUtil(c, "shared", &shared)
+	configAssert(t, nil, bun.Close())
+	expectStopped("shared.key")
+	configAssert(t, false, closed)
+	c.Close()
+	configAssert(t, true, closed)
+
+	// bundle created with NewBundle closes its Util as well
+	closed = false
+	var owned watchedConfig
+	bun = NewBundle("owned", &owned, options)
+	configAssert(t, nil, bun.Close())
+	expectStopped("owned.key")
+	configAssert(t, true, closed)
+}
+
+// triggerConfigSource fires a change event on its watches whenever a value is set with set
+type triggerConfigSource struct {
+	namedConfigSource
+	watches *[]triggerWatch
+}
+
+type triggerWatch struct {
+	key      string
+	prefix   bool
+	callback func(event ChangeEvent)
+}
+
+func newTriggerConfigSource(name string, ordinal int, values map[string]interface{}) triggerConfigSource {
+	return triggerConfigSource{
+		namedConfigSource{mapConfigSource{values: values, ordinal: ordinal, closed: new(bool)}, name},
+		&[]triggerWatch{},
+	}
+}
+
+func (c triggerConfigSource) Subscribe(ctx context.Context, key string, callback func(event ChangeEvent)) {
+	*c.watches = append(*c.watches, triggerWatch{key, false, callback})
+}
+
+func (c triggerConfigSource) SubscribePrefix(ctx context.Context, prefix string, callback func(event ChangeEvent)) {
+	*c.watches = append(*c.watches, triggerWatch{prefix, true, callback})
+}
+
+// set sets or deletes (if value is nil) a value and fires a change event
+func (c triggerConfigSource) set(key string, value interface{}, index uint64) {
+	event := newChangeEvent(key, c.values[key], value, c.name, index)
+	if value == nil {
+		delete(c.values, key)
+	} else {
+		c.values[key] = value
+	}
+	for _, w := range *c.watches {
+		if w.key == key || w.prefix && hasKeyPrefix(key, w.key) {
+			w.callback(event)
+		}
+	}
+}
+
+func TestWatchChangeEvent(t *testing.T) {
+	source := newTriggerConfigSource("map", 200, map[string]interface{}{})
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	var events []ChangeEvent
+	c.Watch("key", func(event ChangeEvent) {
+		events = append(events, event)
+	})
+	var values []string
+	c.Subscribe("key", func(key string, value string) {
+		configAssert(t, "key", key)
+		values = append(values, value)
+	})
+
+	source.set("key", "", 1)
+	source.set("key", nil, 2)
+
+	configAssert(t, 2, len(events))
+	configAssert(t, ChangeCreated, events[0].Type)
+	configAssert(t, "deleted", events[1].Type.String())
+	configAssert(t, nil, events[1].NewValue)
+	configAssert(t, uint64(2), events[1].Index)
+
+	// empty value and deleted key can not be told apart with Subscribe
+	configAssert(t, "|", strings.Join(values, "|"))
+}
+
+func TestWatchShadowing(t *testing.T) {
+	high := newTriggerConfigSource("high", 400, map[string]interface{}{
+		"rest-config.port": "8080",
+	})
+	low := newTriggerConfigSource("low", 50, map[string]interface{}{
+		"rest-config.port": "9090",
+		"rest-config.host": "localhost",
+	})
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{high, low},
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	var events []string
+	record := func(event ChangeEvent) {
+		events = append(events, fmt.Sprintf("%s %s=%v (%s)", event.Type, event.Key, event.NewValue, event.Source))
+	}
+	c.Watch("rest-config.port", record)
+	c.Sub("rest-config").WatchPrefix("", record)
+
+	// shadowed by high
+	low.set("rest-config.port", "9091", 1)
+	// effective value does not change
+	high.set("rest-config.port", "8080", 2)
+	low.set("rest-config.host", "127.0.0.1", 3)
+	// low now supplies the value
+	high.set("rest-config.port", nil, 4)
+	low.set("rest-config.port", nil, 5)
+
+	// keys of watches on Sub are relative to its prefix
+	expected := []string{
+		"updated host=127.0.0.1 (low)",
+		"updated rest-config.port=9091 (low)",
+		"updated port=9091 (low)",
+		"deleted rest-config.port=<nil> (low)",
+		"deleted port=<nil> (low)",
+	}
+	configAssert(t, strings.Join(expected, "\n"), strings.Join(events, "\n"))
+
+	var keys []string
+	c.Sub("rest-config").Subscribe("host", func(key string, value string) {
+		keys = append(keys, key)
+	})
+	low.set("rest-config.host", "localhost", 6)
+	configAssert(t, "host", strings.Join(keys, ","))
+}
+
+func TestBundleSnapshots(t *testing.T) {
+	source := newTriggerConfigSource("map", 400, map[string]interface{}{
+		"rest-config.port": 0,
+		"rest-config.host": "localhost",
+	})
+
+	type restConfig struct {
+		RestConfig struct {
+			Port int    `config:"port,watch"`
+			Host string `config:"host"`
+		} `config:"rest-config"`
+	}
+	var fields restConfig
+	bun := NewBundle("", &fields, Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		Snapshots:  true,
+		LogLevel:   100, // turn off logging
+	})
+	defer bun.conf.Close()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		deadline := time.Now().Add(5 * time.Second)
+		last := 0
+		for last < 1000 && time.Now().Before(deadline) {
+			current := bun.Current().(*restConfig)
+			if current.RestConfig.Port < last || current.RestConfig.Host != "localhost" {
+				t.Errorf("unexpected snapshot %+v after port %d", current.RestConfig, last)
+				return
+			}
+			last = current.RestConfig.Port
+		}
+		configAssert(t, 1000, last)
+	}()
+
+	for i := 1; i <= 1000; i++ {
+		source.set("rest-config.port", i, uint64(i))
+	}
+	<-done
+
+	// fields passed to NewBundle are only filled initially
+	configAssert(t, 0, fields.RestConfig.Port)
+	configAssert(t, "localhost", fields.RestConfig.Host)
+}
+
+func TestBundleChanges(t *testing.T) {
+	source := newTriggerConfigSource("map", 400, map[string]interface{}{
+		"rest-config.port":    8080,
+		"rest-config.timeout": "30s",
+	})
+
+	type restConfig struct {
+		RestConfig struct {
+			Port    int           `config:"port,watch"`
+			Timeout time.Duration `config:"timeout,watch"`
+		} `config:"rest-config"`
+	}
+	var fields restConfig
+	bun := NewBundle("", &fields, Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+	defer bun.conf.Close()
+
+	var changed []string
+	bun.OnChange(func(changedFields []string) {
+		changed = append(changed, changedFields...)
+	})
+	changes := bun.Changes()
+
+	source.set("rest-config.port", 9090, 1)
+	source.set("rest-config.timeout", "1m", 2)
+
+	configAssert(t, "RestConfig.Port,RestConfig.Timeout", strings.Join(changed, ","))
+
+	change := <-changes
+	configAssert(t, "RestConfig.Port", change.Field)
+	configAssert(t, "rest-config.port", change.Key)
+	configAssert(t, 8080, change.Old)
+	configAssert(t, 9090, change.New)
+
+	change = <-changes
+	configAssert(t, "RestConfig.Timeout", change.Field)
+	configAssert(t, 30*time.Second, change.Old)
+	configAssert(t, time.Minute, change.New)
+}
+
+func TestNewBundleFromUtil(t *testing.T) {
+	source := newTriggerConfigSource("map", 400, map[string]interface{}{
+		"rest-config.port":    "not a number",
+		"rest-config.timeout": "also not a duration",
+	})
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	var someConfig struct {
+		Protocol string
+		Version  string
+	}
+	_, err := NewBundleFromUtil(c, "some-config", &someConfig)
+	configAssert(t, nil, err)
+	configAssert(t, "tcp", someConfig.Protocol)
+
+	// unexported fields are skipped, even if configuration holds their keys
+	var unexported struct {
+		Protocol string
+		version  string
+	}
+	_, err = NewBundleFromUtil(c, "some-config", &unexported)
+	configAssert(t, nil, err)
+	configAssert(t, "tcp", unexported.Protocol)
+	configAssert(t, "", unexported.version)
+
+	var restConfig struct {
+		Port    int           `config:"port"`
+		Timeout time.Duration `config:"timeout"`
+		Missing string        `config:"missing"`
+		Map     map[string]string
+	}
+	_, err = NewBundleFromUtil(c, "rest-config", &restConfig)
+	bundleErr, ok := err.(*BundleError)
+	configAssert(t, true, ok)
+	if ok {
+		configAssert(t, 3, len(bundleErr.Errors))
+		_, ok = bundleErr.Errors[0].(*TypeMismatchError)
+		configAssert(t, true, ok)
+		configAssert(t, true, strings.Contains(err.Error(), "rest-config.map"))
+	}
+
+	// invalid fields do not panic
+	for _, fields := range []interface{}{someConfig, new(int), nil} {
+		_, err = NewBundleFromUtil(c, "", fields)
+		_, ok = err.(*BundleError)
+		configAssert(t, true, ok)
+	}
+	// neither does a Util that was not created with NewUtil
+	var required struct {
+		Port int `config:"port,watch,required"`
+	}
+	_, err = NewBundleFromUtil(Util{}, "", &required)
+	_, ok = err.(*BundleError)
+	configAssert(t, true, ok)
+}
+
+func TestBundleNumbers(t *testing.T) {
+	source := newTriggerConfigSource("map", 400, map[string]interface{}{
+		"int8":          -128,
+		"int32":         "7.9",
+		"int64":         "9223372036854775807",
+		"uint8":         255,
+		"uint16":        "0x10",
+		"uint64":        "18446744073709551615",
+		"float32":       1.5,
+		"bytes[0]":      1,
+		"bytes[1]":      "2",
+		"bytes[2]":      3.0,
+		"overflow-int8": 300,
+		"negative-uint": -1,
+		"overflow-f32":  1e39,
+	})
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	var numbers struct {
+		Int8    int8
+		Int32   int32
+		Int64   int64
+		Uint8   uint8
+		Uint16  uint16
+		Uint64  uint64
+		Float32 float32
+		Bytes   []byte
+	}
+	_, err := NewBundleFromUtil(c, "", &numbers)
+	configAssert(t, nil, err)
+	configAssert(t, int8(-128), numbers.Int8)
+	configAssert(t, int32(7), numbers.Int32)
+	configAssert(t, int64(9223372036854775807), numbers.Int64)
+	configAssert(t, uint8(255), numbers.Uint8)
+	configAssert(t, uint16(16), numbers.Uint16)
+	configAssert(t, uint64(18446744073709551615), numbers.Uint64)
+	configAssert(t, float32(1.5), numbers.Float32)
+	configAssert(t, "\x01\x02\x03", string(numbers.Bytes))
+
+	var overflows struct {
+		Int8    int8    `config:"overflow-int8"`
+		Uint    uint    `config:"negative-uint"`
+		Float32 float32 `config:"overflow-f32"`
+	}
+	overflows.Int8 = 1
+	_, err = NewBundleFromUtil(c, "", &overflows)
+	if bundleErr, ok := err.(*BundleError); ok {
+		configAssert(t, 3, len(bundleErr.Errors))
+		for _, fieldErr := range bundleErr.Errors {
+			_, ok := fieldErr.(*RangeError)
+			configAssert(t, true, ok)
+		}
+	} else {
+		t.Errorf("expected=*BundleError, got=%v", err)
+	}
+	// rejected values are not wrapped around
+	configAssert(t, int8(1), overflows.Int8)
+}
+
+func TestBundleDefaults(t *testing.T) {
+	source := newTriggerConfigSource("map", 400, map[string]interface{}{
+		"rest-config.protocol": "tcp",
+	})
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	var restConfig struct {
+		Port     int           `config:"port" default:"8080"`
+		Timeout  time.Duration `config:"timeout" default:"30s"`
+		Retries  int           `config:"retries,watch" default:"3"`
+		Name     string        `config:"name,required" default:"service"`
+		Protocol string        `config:"protocol,watch,required"`
+		Host     string        `config:"host,required"`
+		Servers  []string      `config:"servers,required"`
+		Routes   []string      `config:"routes" default:"/a, /b"`
+		Ports    []int         `config:"ports,required" default:"80,443"`
+	}
+	_, err := NewBundleFromUtil(c.Sub("rest-config"), "", &restConfig)
+
+	configAssert(t, 8080, restConfig.Port)
+	configAssert(t, 30*time.Second, restConfig.Timeout)
+	configAssert(t, 3, restConfig.Retries)
+	configAssert(t, "service", restConfig.Name)
+	configAssert(t, "tcp", restConfig.Protocol)
+	configAssert(t, "[/a /b]", fmt.Sprint(restConfig.Routes))
+	configAssert(t, "[80 443]", fmt.Sprint(restConfig.Ports))
+
+	// every missing required key is reported
+	if bundleErr, ok := err.(*BundleError); ok {
+		var missing []string
+		for _, fieldErr := range bundleErr.Errors {
+			if notFound, ok := fieldErr.(*KeyNotFoundError); ok {
+				missing = append(missing, notFound.Key)
+				// default values are not reported as a configuration source
+				configAssert(t, "map,env,file", strings.Join(notFound.Sources, ","))
+			}
+		}
+		configAssert(t, "rest-config.host,rest-config.servers", strings.Join(missing, ","))
+	} else {
+		t.Errorf("expected=*BundleError, got=%v", err)
+	}
+
+	// watched fields fall back to default values when keys are removed
+	source.set("rest-config.retries", 5, 1)
+	configAssert(t, 5, restConfig.Retries)
+	source.set("rest-config.retries", nil, 2)
+	configAssert(t, 3, restConfig.Retries)
+
+	// lists of structs can not have default values
+	var serverConfig struct {
+		Servers []struct{ Host string } `config:"servers" default:"localhost"`
+	}
+	_, err = NewBundleFromUtil(c, "", &serverConfig)
+	_, ok := err.(*BundleError)
+	configAssert(t, true, ok)
+}
+
+func TestBundleValidation(t *testing.T) {
+	source := newTriggerConfigSource("map", 400, map[string]interface{}{
+		"rest-config.integer-property": 50,
+		"rest-config.protocol":         "udp",
+		"rest-config.name":             "service-1",
+		"rest-config.url":              "localhost",
+		"rest-config.address":          "localhost:8080",
+		"rest-config.timeout":          "2m",
+		"rest-config.tags[0]":          "a",
+	})
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	var restConfig struct {
+		IntegerProperty int           `config:"integer-property,watch" validate:"min=1,max=100"`
+		Protocol        string        `config:"protocol" validate:"oneof=tcp http"`
+		Name            string        `config:"name" validate:"regexp=^[a-z]+-[0-9]{1,3}$"`
+		URL             string        `config:"url" validate:"url"`
+		Address         string        `config:"address" validate:"hostport"`
+		Timeout         time.Duration `config:"timeout" validate:"max=1m"`
+		Tags            []string      `config:"tags" validate:"min=2"`
+		Missing         int           `config:"missing" validate:"min=1"`
+	}
+	bun, err := NewBundleFromUtil(c.Sub("rest-config"), "", &restConfig)
+
+	configAssert(t, 50, restConfig.IntegerProperty)
+	configAssert(t, "service-1", restConfig.Name)
+	configAssert(t, "localhost:8080", restConfig.Address)
+	// fields with invalid values are not filled
+	configAssert(t, "", restConfig.Protocol)
+	configAssert(t, "", restConfig.URL)
+	configAssert(t, time.Duration(0), restConfig.Timeout)
+	configAssert(t, 0, len(restConfig.Tags))
+
+	if bundleErr, ok := err.(*BundleError); ok {
+		var rules []string
+		for _, fieldErr := range bundleErr.Errors {
+			if validationErr, ok := fieldErr.(*ValidationError); ok {
+				rules = append(rules, validationErr.Key+":"+validationErr.Rule)
+			} else {
+				t.Errorf("expected=*ValidationError, got=%v", fieldErr)
+			}
+		}
+		configAssert(t, "rest-config.protocol:oneof=tcp http,rest-config.url:url,"+
+			"rest-config.timeout:max=1m,rest-config.tags:min=2", strings.Join(rules, ","))
+	} else {
+		t.Errorf("expected=*BundleError, got=%v", err)
+	}
+
+	var rejected []*ValidationError
+	bun.OnReject(func(err *ValidationError) {
+		rejected = append(rejected, err)
+	})
+
+	// watched values that violate rules are rejected and the field keeps its old value
+	source.set("rest-config.integer-property", 150, 1)
+	configAssert(t, 50, restConfig.IntegerProperty)
+	source.set("rest-config.integer-property", 100, 2)
+	configAssert(t, 100, restConfig.IntegerProperty)
+
+	if len(rejected) != 1 {
+		t.Fatalf("expected=1 rejection, got=%d", len(rejected))
+	}
+	configAssert(t, "rest-config.integer-property", rejected[0].Key)
+	configAssert(t, 150, rejected[0].Value)
+	configAssert(t, "max=100", rejected[0].Rule)
+}
+
+func TestValidationRules(t *testing.T) {
+	var fields struct {
+		Port    int
+		Ratio   float64
+		Name    string
+		Host    string
+		Filter  string
+		Timeout time.Duration
+	}
+	v := reflect.ValueOf(&fields).Elem()
+	fields.Port = 8080
+	fields.Ratio = 0.5
+	fields.Name = "kumuluzee"
+	fields.Host = "[::1]:99999"
+	fields.Filter = "a,b"
+	fields.Timeout = 90 * time.Second
+
+	tests := []struct {
+		field string
+		rules string
+		valid bool
+	}{
+		{"Port", "min=1,max=65535", true},
+		{"Port", "max=1024", false},
+		{"Ratio", "min=0, max=1", true},
+		{"Ratio", "min=0.6", false},
+		{"Name", "min=3,max=9", true},
+		{"Name", "max=5", false},
+		{"Name", "oneof=kumuluzee go", true},
+		{"Host", "hostport", false},
+		{"Filter", "min=1,regexp=^[a-z]+,[a-z]+$", true},
+		{"Filter", "regexp=^[a-z]+$", false},
+		// bare numbers are in the same unit as duration values (seconds below)
+		{"Timeout", "min=1m,max=100", true},
+		{"Timeout", "max=60", false},
+	}
+	for _, test := range tests {
+		err := validateField("key", v.FieldByName(test.field), test.rules, time.Second)
+		if _, ok := err.(*ValidationError); (err == nil) != test.valid || (err != nil && !ok) {
+			t.Errorf("%s with %s: expected valid=%t, got=%v", test.field, test.rules, test.valid, err)
+		}
+	}
+
+	// invalid rules are reported, but not as validation errors
+	for _, rules := range []string{"unknown", "min=x", "regexp=("} {
+		err := validateField("key", v.FieldByName("Port"), rules, time.Second)
+		if _, ok := err.(*ValidationError); err == nil || ok {
+			t.Errorf("%s: expected an error, got=%v", rules, err)
+		}
+	}
+}
+
+type testLogLevel int
+
+func (l *testLogLevel) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "info":
+		*l = 1
+	case "debug":
+		*l = 2
+	default:
+		return fmt.Errorf("unknown log level %s", text)
+	}
+	return nil
+}
+
+type testEndpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+func (e *testEndpoint) UnmarshalJSON(data []byte) error {
+	type plain testEndpoint
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+type testVersion struct {
+	Major, Minor int
+}
+
+func TestBundleConverters(t *testing.T) {
+	RegisterConverter(reflect.TypeOf(testVersion{}), func(value string) (interface{}, error) {
+		var v testVersion
+		_, err := fmt.Sscanf(value, "%d.%d", &v.Major, &v.Minor)
+		return v, err
+	})
+
+	source := newTriggerConfigSource("map", 400, map[string]interface{}{
+		"rest-config.ip":              "10.0.0.1",
+		"rest-config.ips[0]":          "10.0.0.2",
+		"rest-config.ips[1]":          "10.0.0.3",
+		"rest-config.url":             "http://localhost:8080/api",
+		"rest-config.filter":          "^[a-z]+$",
+		"rest-config.started":         "2019-03-01T10:00:00Z",
+		"rest-config.log-level":       "info",
+		"rest-config.bad-log-level":   "trace",
+		"rest-config.endpoint":        `{"host": "localhost", "port": 8080}`,
+		"rest-config.version":         "1.2",
+		"rest-config.numeric-version": 2.5,
+	})
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	var restConfig struct {
+		IP             net.IP         `config:"ip"`
+		IPs            []net.IP       `config:"ips"`
+		URL            *url.URL       `config:"url"`
+		Filter         *regexp.Regexp `config:"filter"`
+		Started        time.Time      `config:"started"`
+		LogLevel       testLogLevel   `config:"log-level,watch"`
+		BadLogLevel    testLogLevel   `config:"bad-log-level"`
+		Endpoint       testEndpoint   `config:"endpoint"`
+		Version        testVersion    `config:"version"`
+		NumericVersion testVersion    `config:"numeric-version"`
+	}
+	_, err := NewBundleFromUtil(c.Sub("rest-config"), "", &restConfig)
+
+	configAssert(t, "10.0.0.1", restConfig.IP.String())
+	if len(restConfig.IPs) == 2 {
+		configAssert(t, "10.0.0.3", restConfig.IPs[1].String())
+	} else {
+		t.Errorf("expected=2 IPs, got=%v", restConfig.IPs)
+	}
+	if restConfig.URL != nil {
+		configAssert(t, "localhost:8080", restConfig.URL.Host)
+	} else {
+		t.Errorf("expected=URL, got=nil")
+	}
+	if restConfig.Filter != nil {
+		configAssert(t, true, restConfig.Filter.MatchString("abc"))
+	} else {
+		t.Errorf("expected=regexp, got=nil")
+	}
+	configAssert(t, 2019, restConfig.Started.Year())
+	configAssert(t, testLogLevel(1), restConfig.LogLevel)
+	configAssert(t, testLogLevel(0), restConfig.BadLogLevel)
+	configAssert(t, testEndpoint{"localhost", 8080}, restConfig.Endpoint)
+	configAssert(t, testVersion{1, 2}, restConfig.Version)
+	// numbers are passed to converters in their textual form
+	configAssert(t, testVersion{2, 5}, restConfig.NumericVersion)
+
+	if bundleErr, ok := err.(*BundleError); ok && len(bundleErr.Errors) == 1 {
+		if convErr, ok := bundleErr.Errors[0].(*ConversionError); ok {
+			configAssert(t, "rest-config.bad-log-level", convErr.Key)
+		} else {
+			t.Errorf("expected=*ConversionError, got=%v", bundleErr.Errors[0])
+		}
+	} else {
+		t.Errorf("expected=*BundleError with 1 error, got=%v", err)
+	}
+
+	// watched values are converted as well
+	source.set("rest-config.log-level", "debug", 1)
+	configAssert(t, testLogLevel(2), restConfig.LogLevel)
+}
+
+type testBase struct {
+	Name string
+}
+
+type testMeta struct {
+	Version string
+}
+
+type testNode struct {
+	Value int
+	Next  *testNode
+}
+
+func TestBundlePointers(t *testing.T) {
+	source := newTriggerConfigSource("map", 400, map[string]interface{}{
+		"rest-config.name":             "service",
+		"rest-config.user":             "admin",
+		"rest-config.testMeta.version": "1.0.0",
+		"rest-config.database.host":    "localhost",
+		"rest-config.database.port":    5432,
+		"rest-config.port":             8080,
+		"rest-config.host":             "",
+		"rest-config.node.value":       1,
+		"rest-config.node.next.value":  2,
+	})
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{source},
+		Snapshots:  true,
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	// embedded pointers can only be allocated if their type is exported
+	type Auth struct {
+		User string
+	}
+	type restConfig struct {
+		testBase
+		*Auth
+		testMeta `config:",nosquash"`
+		Database *struct {
+			Host string
+			Port int `config:"port,watch"`
+		}
+		Cache *struct {
+			Size int
+		}
+		Pool *struct {
+			Size int `default:"10"`
+		}
+		Port    *int
+		Host    *string
+		Timeout *int
+		Node    *testNode
+	}
+	var fields restConfig
+	bun, err := NewBundleFromUtil(c.Sub("rest-config"), "", &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// embedded structs are squashed, unless tagged with nosquash
+	configAssert(t, "service", fields.Name)
+	if fields.Auth != nil {
+		configAssert(t, "admin", fields.User)
+	} else {
+		t.Errorf("expected=Auth, got=nil")
+	}
+	configAssert(t, "1.0.0", fields.Version)
+
+	// struct pointers are only allocated if configuration holds their values
+	if fields.Database != nil {
+		configAssert(t, "localhost", fields.Database.Host)
+		configAssert(t, 5432, fields.Database.Port)
+	} else {
+		t.Errorf("expected=Database, got=nil")
+	}
+	if fields.Cache != nil {
+		t.Errorf("expected=nil, got=%v", fields.Cache)
+	}
+	if fields.Pool != nil {
+		configAssert(t, 10, fields.Pool.Size)
+	} else {
+		t.Errorf("expected=Pool, got=nil")
+	}
+	if fields.Node != nil && fields.Node.Next != nil {
+		configAssert(t, 2, fields.Node.Next.Value)
+		if fields.Node.Next.Next != nil {
+			t.Errorf("expected=nil, got=%v", fields.Node.Next.Next)
+		}
+	} else {
+		t.Errorf("expected=Node.Next, got=%v", fields.Node)
+	}
+
+	var serverList struct {
+		Servers []*struct {
+			Host string
+			Port int
+		} `config:"server-list"`
+	}
+	NewBundleFromUtil(c, "", &serverList)
+	if len(serverList.Servers) == 2 && serverList.Servers[1] != nil {
+		configAssert(t, "b.example.com", serverList.Servers[1].Host)
+	} else {
+		t.Errorf("expected=2 servers, got=%v", serverList.Servers)
+	}
+
+	// pointers to values are left nil if keys are missing, so that zero values can be told apart
+	if fields.Port != nil && fields.Host != nil {
+		configAssert(t, 8080, *fields.Port)
+		configAssert(t, "", *fields.Host)
+	} else {
+		t.Errorf("expected=Port and Host, got=%v, %v", fields.Port, fields.Host)
+	}
+	if fields.Timeout != nil {
+		t.Errorf("expected=nil, got=%v", *fields.Timeout)
+	}
+
+	// watched changes of fields in nested struct pointers do not modify previous snapshots
+	previous := bun.Current().(*restConfig)
+	source.set("rest-config.database.port", 5433, 1)
+	configAssert(t, 5433, bun.Current().(*restConfig).Database.Port)
+	configAssert(t, 5432, previous.Database.Port)
+	configAssert(t, "localhost", bun.Current().(*restConfig).Database.Host)
+}
@@ -22,7 +22,9 @@
 package config
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"path"
 	"strings"
 	"time"
@@ -34,16 +36,22 @@ import (
 
 type consulConfigSource struct {
 	client          *api.Client
+	kv              consulKV
+	transport       *http.Transport
 	startRetryDelay int64
 	maxRetryDelay   int64
 	namespace       string
-	logger          *logm.Logm
+	ordinal         int
+	// subscriptions are served by a single watch on the whole namespace
+	subscriptions *subscriptionRegistry
+	logger        *logm.Logm
 }
 
-func newConsulConfigSource(conf Util, namespace string, lgr *logm.Logm) configSource {
+func newConsulConfigSource(conf Util, ext Extension, lgr *logm.Logm) ConfigSource {
 	var consulConfig consulConfigSource
 	lgr.Verbose("Initializing %s config source", consulConfig.Name())
 	consulConfig.logger = lgr
+	consulConfig.subscriptions = newSubscriptionRegistry()
 
 	var consulAddress string
 	if addr, ok := conf.GetString("kumuluzee.config.consul.hosts"); ok {
@@ -51,10 +59,16 @@ func newConsulConfigSource(conf Util, namespace string, lgr *logm.Logm) configSo
 	} else {
 		consulAddress = "http://localhost:8500"
 	}
+	// address can be overwritten programmatically by passing it into config.Extension
+	if ext.Hosts != "" {
+		consulAddress = ext.Hosts
+	}
 
-	if client, err := createConsulClient(consulAddress); err == nil {
+	if client, transport, err := createConsulClient(consulAddress); err == nil {
 		lgr.Info("Consul client address set to %v", consulAddress)
 		consulConfig.client = client
+		consulConfig.kv = client.KV()
+		consulConfig.transport = transport
 	} else {
 		lgr.Error("Failed to create Consul client: %s", err.Error())
 	}
@@ -71,107 +85,225 @@ func newConsulConfigSource(conf Util, namespace string, lgr *logm.Logm) configSo
 			consulConfig.namespace = ns
 		}
 	}
-	// ... or programmatically by passing it into config.Options
-	if namespace != "" {
-		consulConfig.namespace = namespace
+	// ... or programmatically by passing it into config.Options (or config.Extension)
+	if ext.Namespace != "" {
+		consulConfig.namespace = ext.Namespace
 	}
 
 	lgr.Info("%s key-value namespace: %s", consulConfig.Name(), consulConfig.namespace)
+	consulConfig.ordinal = ext.Ordinal
+	if consulConfig.ordinal == 0 {
+		consulConfig.ordinal = loadOrdinal(consulConfig, 150, lgr)
+	}
+
 	lgr.Verbose("Initialized %s config source", consulConfig.Name())
 	return consulConfig
 }
 
 func (c consulConfigSource) Get(key string) interface{} {
-	//fmt.Println("[consulConfigSource] Get: " + key)
-	kv := c.client.KV()
-
-	key = strings.Replace(key, ".", "/", -1)
-	//fmt.Printf("KV path: %s\n", path.Join(c.namespace, key))
-
-	pair, _, err := kv.Get(path.Join(c.namespace, key), nil)
+	val, _, err := c.locate(key)
 	if err != nil {
 		c.logger.Warning("Error getting value: %v", err)
 		return nil
 	}
+	return val
+}
+
+func (c consulConfigSource) locate(key string) (interface{}, string, error) {
+	kvPath := path.Join(c.namespace, keyToPath(key))
+	//fmt.Printf("KV path: %s\n", kvPath)
+
+	pair, _, err := c.kv.Get(kvPath, nil)
+	if err != nil {
+		return nil, kvPath, err
+	}
 
 	//fmt.Printf("Pair received: %v\n", pair)
 	if pair == nil {
-		return nil
+		return nil, kvPath, nil
 	}
 	// pair.Value is type []byte
-	return string(pair.Value)
+	return string(pair.Value), kvPath, nil
+}
+
+func (c consulConfigSource) Keys(prefix string) []string {
+	nsPrefix := path.Join(c.namespace, keyToPath(prefix))
+
+	kvPaths, _, err := c.kv.Keys(nsPrefix, "", nil)
+	if err != nil {
+		c.logger.Warning("Error getting keys: %v", err)
+		return nil
+	}
+
+	nsPath := strings.TrimSuffix(c.namespace, "/") + "/"
+
+	keys := make([]string, 0, len(kvPaths))
+	for _, kvPath := range kvPaths {
+		// skip folders and keys outside of namespace
+		if strings.HasSuffix(kvPath, "/") || !strings.HasPrefix(kvPath, nsPath) {
+			continue
+		}
+		key := pathToKey(strings.TrimPrefix(kvPath, nsPath))
+		if hasKeyPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (c consulConfigSource) listSize(key string) (int, bool) {
+	prefix := path.Join(c.namespace, keyToPath(key)) + "/"
+
+	keys, _, err := c.kv.Keys(prefix, "/", nil)
+	if err != nil {
+		c.logger.Warning("Error getting list size: %v", err)
+		return 0, false
+	}
+
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = strings.TrimSuffix(strings.TrimPrefix(k, prefix), "/")
+	}
+	return countIndices(names)
 }
 
-func (c consulConfigSource) Subscribe(key string, callback func(key string, value string)) {
+func (c consulConfigSource) Subscribe(ctx context.Context, key string, callback func(event ChangeEvent)) {
 	c.logger.Info("Creating a watch: key=%s. namespace=%s source=%s", key, c.namespace, c.Name())
-	go c.watch(key, "", c.startRetryDelay, callback, 0)
+	if loopCtx, start := c.subscriptions.add(ctx, key, false, callback); start {
+		go c.watch(loopCtx)
+	}
+}
+
+func (c consulConfigSource) SubscribePrefix(ctx context.Context, prefix string, callback func(event ChangeEvent)) {
+	c.logger.Info("Creating a watch: prefix=%s. namespace=%s source=%s", prefix, c.namespace, c.Name())
+	if loopCtx, start := c.subscriptions.add(ctx, prefix, true, callback); start {
+		go c.watch(loopCtx)
+	}
+}
+
+// Close closes idle connections to Consul. Watches are stopped by canceling their contexts.
+func (c consulConfigSource) Close() error {
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+	return nil
 }
 
 func (c consulConfigSource) Name() string {
 	return "consul"
 }
 
-func (c consulConfigSource) ordinal() int {
-	return 150
+func (c consulConfigSource) Ordinal() int {
+	return c.ordinal
 }
 
-// functions that aren't configSource methods
-
-func (c consulConfigSource) watch(key string, previousValue string, retryDelay int64, callback func(key string, value string), waitIndex uint64) {
+// consulKV is the subset of Consul's KV API used by consulConfigSource, so that it can be replaced
+// in tests
+type consulKV interface {
+	Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+	Keys(prefix, separator string, q *api.QueryOptions) ([]string, *api.QueryMeta, error)
+	List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
+}
 
-	q := api.QueryOptions{
-		WaitIndex: waitIndex,
-		WaitTime:  10 * time.Minute,
-	}
+// functions that aren't ConfigSource methods
 
-	key = strings.Replace(key, ".", "/", -1)
-	c.logger.Verbose("Setting a watch on key %s with %s wait time", key, q.WaitTime)
+// watch runs a single recursive blocking query on the namespace, compares the returned keys with
+// the ones from the previous query and dispatches changed values to subscriptions
+func (c consulConfigSource) watch(ctx context.Context) {
+	nsPath := strings.TrimSuffix(c.namespace, "/") + "/"
+	state := watchState{retryDelay: c.startRetryDelay}
 
-	pair, meta, err := c.client.KV().Get(path.Join(c.namespace, key), &q)
+	// pairs in the namespace by their keys, nil until the first query succeeds
+	var previous map[string]*api.KVPair
 
-	if err != nil {
-		c.logger.Warning("Watch on %s failed with error: %s, retry delay: %d ms", key, err.Error(), retryDelay)
+	for {
+		q := api.QueryOptions{
+			WaitIndex: state.waitIndex,
+			WaitTime:  10 * time.Minute,
+		}
+		c.logger.Verbose("Setting a watch on namespace %s with %s wait time", c.namespace, q.WaitTime)
 
-		// sleep for current delay
-		time.Sleep(time.Duration(retryDelay) * time.Millisecond)
+		pairs, meta, err := c.kv.List(nsPath, q.WithContext(ctx))
 
-		// exponentially extend retry delay, but keep it at most maxRetryDelay
-		newRetryDelay := retryDelay * 2
-		if newRetryDelay > c.maxRetryDelay {
-			newRetryDelay = c.maxRetryDelay
+		// watch was canceled
+		if ctx.Err() != nil {
+			c.logger.Verbose("Watch on namespace %s canceled", c.namespace)
+			return
 		}
-		c.watch(key, "", newRetryDelay, callback, 0)
-		return
-	}
 
-	c.logger.Verbose("Wait time (%s) on watch for key %s reached.", q.WaitTime, key)
+		if err != nil {
+			c.logger.Warning("Watch on namespace %s failed with error: %s, retry delay: %d ms", c.namespace, err.Error(), state.retryDelay)
 
-	if pair != nil {
-		if string(pair.Value) != previousValue {
-			callback(key, string(pair.Value))
-		}
-		c.watch(key, string(pair.Value), c.startRetryDelay, callback, meta.LastIndex)
-	} else {
-		if previousValue != "" {
-			callback(key, "")
+			// sleep for current delay
+			if !sleepContext(ctx, time.Duration(state.retryDelay)*time.Millisecond) {
+				return
+			}
+			state.failed(c.maxRetryDelay)
+			continue
 		}
+
+		c.logger.Verbose("Wait time (%s) on watch for namespace %s reached.", q.WaitTime, c.namespace)
+
 		var lastIndex uint64
 		if meta != nil {
 			lastIndex = meta.LastIndex
 		}
-		c.watch(key, "", c.startRetryDelay, callback, lastIndex)
+
+		current := make(map[string]*api.KVPair, len(pairs))
+		for _, pair := range pairs {
+			// skip folders and keys outside of namespace
+			if strings.HasSuffix(pair.Key, "/") || !strings.HasPrefix(pair.Key, nsPath) {
+				continue
+			}
+			current[pathToKey(strings.TrimPrefix(pair.Key, nsPath))] = pair
+		}
+
+		if previous == nil {
+			// values could have changed since they were recorded by subscribers, but before the
+			// first query returned, so the whole namespace is dispatched. Subscribers only fire
+			// callbacks for values that differ from the ones they recorded.
+			for key, pair := range current {
+				c.subscriptions.dispatch(newChangeEvent(key, nil, string(pair.Value), c.Name(), pair.ModifyIndex))
+			}
+			for _, key := range c.subscriptions.keys() {
+				if _, ok := current[key]; !ok {
+					c.subscriptions.dispatch(ChangeEvent{Key: key, Type: ChangeDeleted, Source: c.Name(), Index: lastIndex})
+				}
+			}
+		} else {
+			for key, pair := range current {
+				if old, ok := previous[key]; !ok {
+					c.subscriptions.dispatch(newChangeEvent(key, nil, string(pair.Value), c.Name(), pair.ModifyIndex))
+				} else if string(old.Value) != string(pair.Value) {
+					c.subscriptions.dispatch(newChangeEvent(key, string(old.Value), string(pair.Value), c.Name(), pair.ModifyIndex))
+				}
+			}
+			for key, old := range previous {
+				if _, ok := current[key]; !ok {
+					// deleted keys have no modify index, use index of the query instead
+					c.subscriptions.dispatch(newChangeEvent(key, string(old.Value), nil, c.Name(), lastIndex))
+				}
+			}
+		}
+		previous = current
+
+		// index went backwards (i.e. Consul was restarted), start over
+		if lastIndex < state.waitIndex {
+			lastIndex = 0
+		}
+		state.succeeded(lastIndex, c.startRetryDelay)
 	}
 }
 
-// functions that aren't configSource methods or etcdCondigSource methods
+// functions that aren't ConfigSource methods or etcdCondigSource methods
 
-func createConsulClient(address string) (*api.Client, error) {
+func createConsulClient(address string) (*api.Client, *http.Transport, error) {
 	clientConfig := api.DefaultConfig()
 	clientConfig.Address = address
 
 	client, err := api.NewClient(clientConfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return client, nil
+	return client, clientConfig.Transport, nil
 }
@@ -22,7 +22,16 @@
 package config
 
 import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mc0239/logm"
 )
 
 func consulAssert(t *testing.T, expected interface{}, got interface{}) {
@@ -155,3 +164,323 @@ func TestConsulConfigDeep(t *testing.T) {
 		consulAssert(t, 6, i)
 	}
 }
+
+func TestConsulConfigUnavailable(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	cl, _, _ := createConsulClient("http://127.0.0.1:1")
+	c := Util{
+		configSources: []ConfigSource{consulConfigSource{client: cl, kv: cl.KV(), namespace: "test", logger: &lgr}},
+		logger:        &lgr,
+	}
+
+	_, err := c.GetStringE("string-value")
+	if suErr, ok := err.(*SourceUnavailableError); !ok {
+		consulAssert(t, "*SourceUnavailableError", err)
+	} else if suErr.Key != "string-value" || suErr.Source != "consul" || suErr.Err == nil {
+		consulAssert(t, "string-value/consul", suErr)
+	}
+}
+
+func TestConsulConfigUnavailableFallback(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	cl, _, _ := createConsulClient("http://127.0.0.1:1")
+	c := Util{
+		configSources: []ConfigSource{
+			consulConfigSource{client: cl, kv: cl.KV(), namespace: "test", ordinal: 150, logger: &lgr},
+			newFileConfigSource("../test/config.yaml", &lgr),
+		},
+		logger: &lgr,
+	}
+	defer c.Close()
+
+	// value from configuration file is used, but the failure of Consul is reported in its origin
+	val, origin, ok := c.GetWithSource("string-value")
+	if !ok || val != "hey ho" || origin.Source != "file" {
+		consulAssert(t, "hey ho from file", val)
+	}
+	if suErr, ok := origin.Unavailable.(*SourceUnavailableError); !ok || suErr.Source != "consul" {
+		consulAssert(t, "*SourceUnavailableError from consul", origin.Unavailable)
+	}
+}
+
+// fakeConsulKV simulates a Consul key-value store, where every blocking query on the namespace
+// returns a new value of some-config/protocol, except every 100th query, which fails
+type fakeConsulKV struct {
+	updates int
+	calls   int
+	cancel  context.CancelFunc
+}
+
+func (f *fakeConsulKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	return nil, nil, nil
+}
+
+func (f *fakeConsulKV) Keys(prefix, separator string, q *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	return nil, nil, nil
+}
+
+func (f *fakeConsulKV) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	f.calls++
+	if f.calls > f.updates {
+		f.cancel()
+		return nil, nil, context.Canceled
+	}
+	if f.calls%100 == 0 {
+		return nil, nil, errors.New("connection refused")
+	}
+	if q.WaitIndex != uint64(f.calls-1) && f.calls%100 != 1 {
+		return nil, nil, errors.New("unexpected wait index " + strconv.Itoa(int(q.WaitIndex)))
+	}
+	pairs := api.KVPairs{
+		{Key: prefix + "some-config/"},
+		{Key: prefix + "some-config/protocol", Value: []byte(strconv.Itoa(f.calls))},
+		{Key: prefix + "some-config/version", Value: []byte("1.0.0")},
+	}
+	return pairs, &api.QueryMeta{LastIndex: uint64(f.calls)}, nil
+}
+
+func TestConsulConfigWatchLoop(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kv := &fakeConsulKV{updates: 5000, cancel: cancel}
+	c := consulConfigSource{kv: kv, namespace: "test", maxRetryDelay: 1, subscriptions: newSubscriptionRegistry(), logger: &lgr}
+
+	callbacks := 0
+	stackDepth := 0
+	c.subscriptions.add(ctx, "some-config.protocol", false, func(event ChangeEvent) {
+		// the first query dispatches the whole namespace
+		expectedType := ChangeUpdated
+		if kv.calls == 1 {
+			expectedType = ChangeCreated
+		}
+		callbacks++
+		// stack must not grow with every update
+		depth := runtime.Callers(0, make([]uintptr, 100))
+		if stackDepth == 0 {
+			stackDepth = depth
+		} else if depth != stackDepth {
+			t.Fatalf("stack depth changed from %d to %d", stackDepth, depth)
+		}
+		if event.Key != "some-config.protocol" || event.Type != expectedType || event.Source != "consul" {
+			consulAssert(t, "some-config.protocol updated in consul", event)
+		}
+		if event.NewValue != strconv.Itoa(kv.calls) {
+			consulAssert(t, kv.calls, event.NewValue)
+		}
+	})
+	c.subscriptions.add(ctx, "some-config.version", false, func(event ChangeEvent) {
+		if kv.calls > 1 {
+			consulAssert(t, "no callback on unchanged key", event)
+		}
+	})
+
+	c.watch(ctx)
+
+	// every 100th query failed
+	if callbacks != 5000-50 {
+		consulAssert(t, 5000-50, callbacks)
+	}
+}
+
+// blockingConsulKV simulates a Consul key-value store, where blocking queries on the namespace
+// return when a new list of pairs is sent to the updates channel
+type blockingConsulKV struct {
+	fakeConsulKV
+	updates chan api.KVPairs
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (f *blockingConsulKV) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	f.mu.Lock()
+	f.active++
+	if f.active > f.maxActive {
+		f.maxActive = f.active
+	}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.active--
+		f.mu.Unlock()
+	}()
+
+	select {
+	case pairs := <-f.updates:
+		return pairs, &api.QueryMeta{}, nil
+	case <-q.Context().Done():
+		return nil, nil, q.Context().Err()
+	}
+}
+
+func TestConsulConfigWatchMultiplexing(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	kv := &blockingConsulKV{updates: make(chan api.KVPairs)}
+	c := consulConfigSource{kv: kv, namespace: "test", subscriptions: newSubscriptionRegistry(), logger: &lgr}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan string, 100)
+	for i := 0; i < 40; i++ {
+		c.Subscribe(ctx, "key"+strconv.Itoa(i), func(event ChangeEvent) {
+			changes <- event.Type.String() + " " + event.Key + "=" + valueString(event.NewValue)
+		})
+	}
+
+	kv.updates <- api.KVPairs{
+		{Key: "test/key0", Value: []byte("a")},
+		{Key: "test/key1", Value: []byte("a")},
+	}
+	kv.updates <- api.KVPairs{
+		{Key: "test/key0", Value: []byte("b")},
+		{Key: "test/key1", Value: []byte("a")},
+		{Key: "test/key2", Value: []byte("c")},
+		{Key: "test/other", Value: []byte("c")},
+	}
+	kv.updates <- api.KVPairs{
+		{Key: "test/key0", Value: []byte("b")},
+		{Key: "test/key2", Value: []byte("c")},
+	}
+
+	// the first query dispatches the whole namespace, including subscribed keys that do not exist
+	expectChanges(t, changes, "created key0=a", "created key1=a", "deleted key2=",
+		"updated key0=b", "created key2=c", "deleted key1=")
+
+	kv.mu.Lock()
+	if kv.maxActive != 1 {
+		consulAssert(t, 1, kv.maxActive)
+	}
+	kv.mu.Unlock()
+
+	// watch stops after all subscriptions are canceled
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		kv.mu.Lock()
+		active := kv.active
+		kv.mu.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("watch on namespace was not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConsulConfigWatchPrefix(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	kv := &blockingConsulKV{updates: make(chan api.KVPairs)}
+	c := consulConfigSource{kv: kv, namespace: "test", subscriptions: newSubscriptionRegistry(), logger: &lgr}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 100)
+	c.SubscribePrefix(ctx, "rest-config", func(event ChangeEvent) {
+		changes <- event.Type.String() + " " + event.Key + "=" + valueString(event.NewValue)
+	})
+
+	kv.updates <- api.KVPairs{
+		{Key: "test/rest-config/port", Value: []byte("8080")},
+		{Key: "test/rest-config/routes/[0]", Value: []byte("/a")},
+	}
+	kv.updates <- api.KVPairs{
+		{Key: "test/rest-config/port", Value: []byte("9090")},
+		{Key: "test/rest-config/routes/[1]", Value: []byte("/b")},
+		{Key: "test/rest-configuration", Value: []byte("other")},
+		{Key: "test/other-config/port", Value: []byte("8080")},
+	}
+	// the second update has been dispatched when the next query is made
+	kv.updates <- api.KVPairs{
+		{Key: "test/rest-config/port", Value: []byte("9090")},
+		{Key: "test/rest-config/routes/[1]", Value: []byte("/b")},
+		{Key: "test/rest-configuration", Value: []byte("other")},
+		{Key: "test/other-config/port", Value: []byte("8080")},
+	}
+	if len(changes) != 5 {
+		consulAssert(t, 5, len(changes))
+	}
+
+	expectChanges(t, changes,
+		"created rest-config.port=8080",
+		"created rest-config.routes[0]=/a",
+		"updated rest-config.port=9090",
+		"created rest-config.routes[1]=/b",
+		"deleted rest-config.routes[0]=",
+	)
+}
+
+// expectChanges waits until all expected changes, formatted as "<type> <key>=<new value>", are
+// received, in any order
+func expectChanges(t *testing.T, changes chan string, expected ...string) {
+	received := make(map[string]bool)
+	for _, change := range expected {
+		for !received[change] {
+			select {
+			case change := <-changes:
+				received[change] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected changes %v, got: %v", expected, received)
+			}
+		}
+	}
+}
+
+// changingConsulKV holds a single value of some-config/protocol, which is returned by Get, while
+// blocking queries on the namespace return updates
+type changingConsulKV struct {
+	*blockingConsulKV
+	value string
+}
+
+func (f *changingConsulKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key != "test/some-config/protocol" {
+		return nil, nil, nil
+	}
+	return &api.KVPair{Key: key, Value: []byte(f.value)}, &api.QueryMeta{}, nil
+}
+
+func (f *changingConsulKV) set(value string) {
+	f.mu.Lock()
+	f.value = value
+	f.mu.Unlock()
+}
+
+func TestConsulConfigWatchFirstQuery(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	kv := &changingConsulKV{blockingConsulKV: &blockingConsulKV{updates: make(chan api.KVPairs)}, value: "a"}
+	c := Util{
+		configSources: []ConfigSource{
+			consulConfigSource{kv: kv, namespace: "test", subscriptions: newSubscriptionRegistry(), logger: &lgr},
+		},
+		logger: &lgr,
+	}
+
+	changes := make(chan string, 10)
+	sub := c.Watch("some-config.protocol", func(event ChangeEvent) {
+		changes <- event.Type.String() + " " + event.Key + "=" + valueString(event.NewValue)
+	})
+	defer sub.Unsubscribe()
+
+	// the value changes after the watch recorded it, but before the first query returns
+	kv.set("b")
+	kv.updates <- api.KVPairs{{Key: "test/some-config/protocol", Value: []byte("b"), ModifyIndex: 1}}
+
+	expectChanges(t, changes, "updated some-config.protocol=b")
+}
@@ -0,0 +1,177 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Converter converts a configuration value to a value of the type it is registered for. Values
+// that are not strings (i.e. numbers from a YAML file) are passed in their textual form.
+type Converter func(value string) (interface{}, error)
+
+// converters holds converters registered with RegisterConverter
+var converters = struct {
+	sync.RWMutex
+	byType map[reflect.Type]Converter
+}{
+	byType: map[reflect.Type]Converter{
+		reflect.TypeOf((*url.URL)(nil)): func(value string) (interface{}, error) {
+			return url.Parse(value)
+		},
+		reflect.TypeOf((*regexp.Regexp)(nil)): func(value string) (interface{}, error) {
+			return regexp.Compile(value)
+		},
+	},
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// RegisterConverter registers a converter, which is used to fill Bundle fields of type t. Converter
+// has to return a value assignable to t. Converters take precedence over encoding.TextUnmarshaler
+// and json.Unmarshaler implementations, as well as over built-in conversions, and replace any
+// converter previously registered for the same type.
+func RegisterConverter(t reflect.Type, converter Converter) {
+	converters.Lock()
+	defer converters.Unlock()
+	converters.byType[t] = converter
+}
+
+// lookupConverter returns a converter registered for type t
+func lookupConverter(t reflect.Type) (Converter, bool) {
+	converters.RLock()
+	defer converters.RUnlock()
+	converter, ok := converters.byType[t]
+	return converter, ok
+}
+
+// isConvertible reports whether fields of type t are filled by a registered converter or one of
+// the unmarshaler interfaces, rather than by their kind
+func isConvertible(t reflect.Type) bool {
+	if _, ok := lookupConverter(t); ok {
+		return true
+	}
+	pt := unmarshalerType(t)
+	return pt.Implements(textUnmarshalerType) || pt.Implements(jsonUnmarshalerType)
+}
+
+// unmarshalerType returns the pointer type that unmarshalers for fields of type t are called on:
+// t itself for pointer types (i.e. *url.URL), otherwise a pointer to t
+func unmarshalerType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t
+	}
+	return reflect.PtrTo(t)
+}
+
+// setConvertedWithReflect fills a field of a convertible type (see isConvertible) with the value of
+// a given key. Errors returned by converters and unmarshalers are wrapped in a *ConversionError.
+func setConvertedWithReflect(key string, value reflect.Value, bun Bundle) error {
+	rvalue, origin, err := bun.conf.lookup(key)
+	if err != nil {
+		return fieldError(err)
+	}
+	fullKey := bun.conf.fullKey(key)
+	t := value.Type()
+
+	conversionError := func(err error) error {
+		return &ConversionError{fullKey, origin.Source, rvalue, t.String(), err}
+	}
+
+	if converter, ok := lookupConverter(t); ok {
+		text, ok := valueText(rvalue)
+		if !ok {
+			return &TypeMismatchError{fullKey, origin.Source, rvalue, t.String()}
+		}
+		converted, err := converter(text)
+		if err != nil {
+			return conversionError(err)
+		}
+		cvalue := reflect.ValueOf(converted)
+		if !cvalue.IsValid() || !cvalue.Type().AssignableTo(t) {
+			return conversionError(fmt.Errorf("converter returned %T", converted))
+		}
+		value.Set(cvalue)
+		return nil
+	}
+
+	// unmarshal into a new value, so that field is left unchanged on errors
+	target := reflect.New(unmarshalerType(t).Elem())
+	switch unmarshaler := target.Interface().(type) {
+	case encoding.TextUnmarshaler:
+		text, ok := valueText(rvalue)
+		if !ok {
+			return &TypeMismatchError{fullKey, origin.Source, rvalue, t.String()}
+		}
+		err = unmarshaler.UnmarshalText([]byte(text))
+	case json.Unmarshaler:
+		var data []byte
+		data, err = valueJSON(rvalue)
+		if err == nil {
+			err = unmarshaler.UnmarshalJSON(data)
+		}
+	}
+	if err != nil {
+		return conversionError(err)
+	}
+
+	if t.Kind() == reflect.Ptr {
+		value.Set(target)
+	} else {
+		value.Set(target.Elem())
+	}
+	return nil
+}
+
+// valueText returns the textual form of a scalar configuration value
+func valueText(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// valueJSON encodes a configuration value as JSON. Strings holding valid JSON (i.e. JSON objects
+// stored in Consul) are passed as they are, other strings are encoded as JSON strings.
+func valueJSON(val interface{}) ([]byte, error) {
+	if s, ok := val.(string); ok && json.Valid([]byte(s)) {
+		return []byte(s), nil
+	}
+	return json.Marshal(val)
+}
@@ -0,0 +1,115 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationType is the reflect.Type of time.Duration, used to tell durations apart from int64 fields
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ISO-8601 duration in format PnDTnHnMn.nS, as accepted by java.time.Duration
+var isoDurationRegexp = regexp.MustCompile(`(?i)^([-+]?)P(?:([-+]?[0-9]+)D)?` +
+	`(T(?:([-+]?[0-9]+)H)?(?:([-+]?[0-9]+)M)?(?:([-+]?[0-9]+)(?:[.,]([0-9]{0,9}))?S)?)?$`)
+
+// convertDuration converts a configuration value to time.Duration. Strings are parsed as Go
+// durations (i.e. "1m30s") or ISO-8601 durations (i.e. "PT1M30S"), while numbers (and numeric
+// strings) are multiplied by the given unit.
+func convertDuration(val interface{}, unit time.Duration) (time.Duration, bool) {
+	if nvalue, ok := assertAsNumber(val); ok {
+		return numberToDuration(nvalue, unit)
+	}
+
+	svalue, ok := val.(string)
+	if !ok {
+		return 0, false
+	}
+	svalue = strings.TrimSpace(svalue)
+
+	if fvalue, err := strconv.ParseFloat(svalue, 64); err == nil {
+		return numberToDuration(fvalue, unit)
+	}
+	if dvalue, err := time.ParseDuration(svalue); err == nil {
+		return dvalue, true
+	}
+	return parseISODuration(svalue)
+}
+
+func numberToDuration(num float64, unit time.Duration) (time.Duration, bool) {
+	d := num * float64(unit)
+	if math.IsNaN(d) || d >= math.MaxInt64 || d < math.MinInt64 {
+		return 0, false
+	}
+	return time.Duration(d), true
+}
+
+func parseISODuration(s string) (time.Duration, bool) {
+	m := isoDurationRegexp.FindStringSubmatch(s)
+	// reject "P", "PT" and "P1DT", which match but carry no components
+	if m == nil || (m[2] == "" && m[3] == "") || strings.EqualFold(m[3], "T") {
+		return 0, false
+	}
+
+	var total float64
+	units := []struct {
+		group int
+		unit  time.Duration
+	}{
+		{2, 24 * time.Hour},
+		{4, time.Hour},
+		{5, time.Minute},
+		{6, time.Second},
+	}
+	for _, u := range units {
+		if m[u.group] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(m[u.group], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		total += float64(n) * float64(u.unit)
+	}
+
+	if m[7] != "" {
+		// fraction of seconds has the same sign as seconds
+		frac, _ := strconv.ParseFloat("0."+m[7], 64)
+		if strings.HasPrefix(m[6], "-") {
+			frac = -frac
+		}
+		total += frac * float64(time.Second)
+	}
+
+	if m[1] == "-" {
+		total = -total
+	}
+	if total >= math.MaxInt64 || total < math.MinInt64 {
+		return 0, false
+	}
+	return time.Duration(total), true
+}
@@ -0,0 +1,65 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseISODuration(t *testing.T) {
+	valid := map[string]time.Duration{
+		"PT30S":       30 * time.Second,
+		"PT1M30S":     90 * time.Second,
+		"pt1h":        time.Hour,
+		"P2D":         48 * time.Hour,
+		"P1DT2H":      26 * time.Hour,
+		"PT1.5S":      1500 * time.Millisecond,
+		"PT-0.5S":     -500 * time.Millisecond,
+		"-PT10M":      -10 * time.Minute,
+		"PT0.000001S": time.Microsecond,
+	}
+	for s, expected := range valid {
+		if d, ok := parseISODuration(s); !(ok && d == expected) {
+			t.Errorf("%s: expected=%v, got=%v", s, expected, d)
+		}
+	}
+
+	// durations that do not fit into time.Duration (2^63 ns and more) are rejected as well
+	invalid := []string{"", "P", "PT", "P1DT", "PT1.5M", "1M", "PT1S2M", "PT9223372036.854775808S", "P106752D"}
+	for _, s := range invalid {
+		if d, ok := parseISODuration(s); ok {
+			t.Errorf("%s: expected parsing to fail, got=%v", s, d)
+		}
+	}
+}
+
+func TestConvertDurationOverflow(t *testing.T) {
+	for _, value := range []interface{}{"9223372036854775807", 9223372036854775807, 1e19} {
+		if d, ok := convertDuration(value, time.Nanosecond); ok {
+			t.Errorf("%v: expected conversion to fail, got=%v", value, d)
+		}
+	}
+	if d, ok := convertDuration("9223372036854775807", time.Millisecond); ok {
+		t.Errorf("expected conversion to fail, got=%v", d)
+	}
+}
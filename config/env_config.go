@@ -22,36 +22,136 @@
 package config
 
 import (
+	"context"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/mc0239/logm"
 )
 
 type envConfigSource struct {
+	ordinal int
 }
 
-func newEnvConfigSource(lgr *logm.Logm) configSource {
+func newEnvConfigSource(lgr *logm.Logm) ConfigSource {
 	var c envConfigSource
 	lgr.Verbose("Initializing %s config source", c.Name())
+	c.ordinal = loadOrdinal(c, 300, lgr)
 	lgr.Verbose("Initialized %s config source", c.Name())
 	return c
 }
 
 func (c envConfigSource) Get(key string) interface{} {
+	value, _, _ := c.locate(key)
+	return value
+}
+
+func (c envConfigSource) locate(key string) (interface{}, string, error) {
 
 	for _, keyName := range getPossibleNames(key) {
 		value, exists := os.LookupEnv(keyName)
 		if exists {
-			return value
+			return value, keyName, nil
+		}
+	}
+
+	return nil, "", nil
+}
+
+func (c envConfigSource) Keys(prefix string) []string {
+	var prefixNames []string
+	if prefix != "" {
+		prefixNames = getPossibleNames(prefix)
+	}
+
+	set := make(map[string]bool)
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+
+		if prefix == "" {
+			set[envNameToKey(name)] = true
+			continue
+		}
+		for _, prefixName := range prefixNames {
+			if name == prefixName {
+				set[prefix] = true
+			} else if strings.HasPrefix(name, prefixName+"_") {
+				set[joinKey(prefix, envNameToKey(name[len(prefixName)+1:]))] = true
+			} else {
+				continue
+			}
+			break
+		}
+	}
+
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		// "[0].sub" must not be prefixed with a dot
+		key = strings.Replace(key, ".[", "[", -1)
+		if isValidEnvKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// isValidEnvKey reports whether a key derived from an environment variable name has no empty
+// segments, which are left by leading, trailing or repeated underscores (i.e. variable _)
+func isValidEnvKey(key string) bool {
+	for _, segment := range strings.Split(key, ".") {
+		if segment == "" || strings.HasPrefix(segment, "[") {
+			return false
+		}
+	}
+	return true
+}
+
+func (c envConfigSource) listSize(key string) (int, bool) {
+	names := make(map[string]bool)
+	for _, env := range os.Environ() {
+		names[strings.SplitN(env, "=", 2)[0]] = true
+	}
+
+	// element exists if it is set directly (i.e. KEY_0) or any of its children is set (KEY_0_SUB)
+	elementExists := func(elementKey string) bool {
+		for _, keyName := range getPossibleNames(elementKey) {
+			if names[keyName] {
+				return true
+			}
+			for name := range names {
+				if strings.HasPrefix(name, keyName+"_") {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	n := 0
+	for elementExists(indexKey(key, n)) {
+		n++
+	}
+	return n, n > 0
+}
+
+func (c envConfigSource) candidates(key string) []Candidate {
+	names := getPossibleNames(key)
+	candidates := make([]Candidate, len(names))
+
+	for i, keyName := range names {
+		value, exists := os.LookupEnv(keyName)
+		candidates[i] = Candidate{possibleNameKinds[i], keyName, exists, nil}
+		if exists {
+			candidates[i].Value = value
 		}
 	}
 
-	return nil
+	return candidates
 }
 
-func (c envConfigSource) Subscribe(key string, callback func(key string, value string)) {
+func (c envConfigSource) Subscribe(ctx context.Context, key string, callback func(event ChangeEvent)) {
 	return
 }
 
@@ -59,12 +159,15 @@ func (c envConfigSource) Name() string {
 	return "env"
 }
 
-func (c envConfigSource) ordinal() int {
-	return 300
+func (c envConfigSource) Ordinal() int {
+	return c.ordinal
 }
 
 //
 
+// possibleNameKinds describe names returned by getPossibleNames, in the same order
+var possibleNameKinds = []string{"raw", "normalized", "upper", "legacy1", "legacy2", "indexed"}
+
 // https://github.com/kumuluz/kumuluzee/blob/master/common/src/main/java/com/kumuluz/ee/configuration/sources/EnvironmentConfigurationSource.java#L224
 func getPossibleNames(key string) []string {
 	possibleNames := []string{
@@ -74,6 +177,7 @@ func getPossibleNames(key string) []string {
 		normalizeKeyUpper(key),
 		parseKeyLegacy1(key),
 		parseKeyLegacy2(key),
+		parseKeyIndexed(key),
 	}
 
 	return possibleNames
@@ -105,3 +209,46 @@ func parseKeyLegacy1(key string) string {
 func parseKeyLegacy2(key string) string {
 	return strings.ToUpper(strings.Replace(key, ".", "_", -1))
 }
+
+// indexed: replaces list indices "[i]" with "_i" and normalizes to uppercase, i.e. key[0].sub to
+// KEY_0_SUB
+func parseKeyIndexed(key string) string {
+	return normalizeKeyUpper(strings.Replace(strings.Replace(key, "[", "_", -1), "]", "", -1))
+}
+
+// envNameToKey converts an environment variable name to a key by lowercasing it and replacing
+// underscores with dots. Numeric segments are treated as list indices, i.e. SERVERS_0_PORT maps to
+// servers[0].port
+func envNameToKey(name string) string {
+	segments := strings.Split(strings.ToLower(name), "_")
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil {
+			segments[i] = "[" + segment + "]"
+		}
+	}
+	return strings.Replace(strings.Join(segments, "."), ".[", "[", -1)
+}
+
+// matchEnvKeys returns keys derived from environment variable names, replacing each one with a
+// known key (from other configuration sources) that maps to the same environment variable name.
+// If onlyKnown is true, keys that do not map to a known key are dropped.
+func matchEnvKeys(envKeys []string, known map[string]bool, onlyKnown bool) []string {
+	if len(envKeys) == 0 {
+		return nil
+	}
+
+	knownNames := make(map[string]string)
+	for key := range known {
+		knownNames[parseKeyIndexed(key)] = key
+	}
+
+	keys := make([]string, 0, len(envKeys))
+	for _, key := range envKeys {
+		if knownKey, ok := knownNames[parseKeyIndexed(key)]; ok {
+			keys = append(keys, knownKey)
+		} else if !onlyKnown {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -22,6 +22,8 @@
 package config
 
 import (
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -37,11 +39,159 @@ func TestEnvKey(t *testing.T) {
 	expNorm2 := []string{"KUMULUZEE", "KUMULUZEE_0_", "LEV1_LEV2_5__LEV3", "V_RY_C00L"}
 	expLeg1 := []string{"KUMULUZEE", "KUMULUZEE0", "LEV1_LEV25_LEV3", "V€RYC00L"}
 	expLeg2 := []string{"KUMULUZEE", "KUMULUZEE[0]", "LEV1_LEV2[5]_LEV3", "V€RY-C00L"}
+	expIdx := []string{"KUMULUZEE", "KUMULUZEE_0", "LEV1_LEV2_5_LEV3", "V_RY_C00L"}
 
 	for i, keyName := range keys {
 		envAssert(t, expNorm[i], normalizeKey(keyName))
 		envAssert(t, expNorm2[i], normalizeKeyUpper(keyName))
 		envAssert(t, expLeg1[i], parseKeyLegacy1(keyName))
 		envAssert(t, expLeg2[i], parseKeyLegacy2(keyName))
+		envAssert(t, expIdx[i], parseKeyIndexed(keyName))
 	}
 }
+
+func TestEnvGetWithSource(t *testing.T) {
+	os.Setenv("SOME_CONFIG_PROTOCOL", "udp")
+	defer os.Unsetenv("SOME_CONFIG_PROTOCOL")
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	val, origin, ok := c.GetWithSource("some-config.protocol")
+	envAssert(t, true, ok)
+	envAssert(t, "udp", val)
+	envAssert(t, Origin{"env", 300, "SOME_CONFIG_PROTOCOL", nil}, origin)
+
+	val, origin, ok = c.GetWithSource("some-config.address.ip")
+	envAssert(t, true, ok)
+	envAssert(t, "127.0.0.2", val)
+	envAssert(t, Origin{"file", 100, "some-config.address.ip", nil}, origin)
+
+	_, _, ok = c.GetWithSource("some-config.non-existent")
+	envAssert(t, false, ok)
+}
+
+func TestEnvExplain(t *testing.T) {
+	os.Setenv("SOME_CONFIG_PROTOCOL", "udp")
+	os.Setenv("SOMECONFIG_PASSWORD", "hunter2")
+	defer os.Unsetenv("SOME_CONFIG_PROTOCOL")
+	defer os.Unsetenv("SOMECONFIG_PASSWORD")
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	exp := c.Explain("some-config.protocol")
+	envAssert(t, true, exp.Found)
+	envAssert(t, "udp", exp.Value)
+	envAssert(t, "env", exp.Origin.Source)
+	envAssert(t, 2, len(exp.Sources))
+	envAssert(t, 6, len(exp.Sources[0].Candidates))
+	envAssert(t, "some-config.protocol", exp.Sources[0].Candidates[0].Name)
+	envAssert(t, false, exp.Sources[0].Candidates[0].Found)
+	envAssert(t, "SOME_CONFIG_PROTOCOL", exp.Sources[0].Candidates[2].Name)
+	envAssert(t, true, exp.Sources[0].Candidates[2].Found)
+	envAssert(t, "file", exp.Sources[1].Name)
+	envAssert(t, true, exp.Sources[1].Found)
+	envAssert(t, "tcp", exp.Sources[1].Value)
+
+	exp = c.Explain("some-config.password")
+	envAssert(t, true, exp.Found)
+	envAssert(t, maskedValue, exp.Value)
+	envAssert(t, maskedValue, exp.Sources[0].Candidates[3].Value)
+	envAssert(t, false, exp.Sources[1].Found)
+}
+
+func TestEnvList(t *testing.T) {
+	os.Setenv("SERVER_LIST_1_PORT", "9090")
+	os.Setenv("ENV_LIST_0", "first")
+	os.Setenv("ENV_LIST_1", "second")
+	defer os.Unsetenv("SERVER_LIST_1_PORT")
+	defer os.Unsetenv("ENV_LIST_0")
+	defer os.Unsetenv("ENV_LIST_1")
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	i, ok := c.GetInt("server-list[1].port")
+	envAssert(t, true, ok)
+	envAssert(t, 9090, i)
+
+	s, ok := c.GetStringSlice("env-list")
+	envAssert(t, true, ok)
+	envAssert(t, 2, len(s))
+	envAssert(t, "second", s[1])
+}
+
+func TestEnvListElementOverride(t *testing.T) {
+	os.Setenv("YAML_ARRAY_0", "override")
+	defer os.Unsetenv("YAML_ARRAY_0")
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	// only the first element is overridden, the rest of the list comes from configuration file
+	n, ok := c.GetListSize("yaml-array")
+	envAssert(t, true, ok)
+	envAssert(t, 4, n)
+
+	s, ok := c.GetStringSlice("yaml-array")
+	envAssert(t, true, ok)
+	envAssert(t, 4, len(s))
+	envAssert(t, "override", s[0])
+	envAssert(t, "entry4", s[3])
+}
+
+func TestEnvKeys(t *testing.T) {
+	os.Setenv("SOME_CONFIG_PROTOCOL", "udp")
+	os.Setenv("SOME_CONFIG_TIMEOUT", "10")
+	os.Setenv("SERVER_LIST_2_HOST", "c.example.com")
+	os.Setenv("SOME_CONFIG__EMPTY_", "empty segments")
+	defer os.Unsetenv("SOME_CONFIG__EMPTY_")
+	defer os.Unsetenv("SOME_CONFIG_PROTOCOL")
+	defer os.Unsetenv("SOME_CONFIG_TIMEOUT")
+	defer os.Unsetenv("SERVER_LIST_2_HOST")
+
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	expected := []string{"some-config.address.ip", "some-config.address.port", "some-config.protocol",
+		"some-config.some-boolean", "some-config.timeout", "some-config.version"}
+	keys := c.Keys("some-config")
+	envAssert(t, len(expected), len(keys))
+	for i := range expected {
+		if i < len(keys) {
+			envAssert(t, expected[i], keys[i])
+		}
+	}
+
+	keys = c.Keys("server-list")
+	envAssert(t, 5, len(keys))
+	envAssert(t, "server-list[2].host", keys[4])
+
+	keys = c.Sub("some-config").Keys("address")
+	envAssert(t, 2, len(keys))
+	envAssert(t, "address.ip", keys[0])
+
+	// without prefix, only environment variables that override keys from other sources are listed
+	found := make(map[string]bool)
+	for _, key := range c.Keys("") {
+		found[key] = true
+		if strings.HasPrefix(key, ".") || strings.HasSuffix(key, ".") || strings.Contains(key, "..") {
+			t.Errorf("invalid key %q", key)
+		}
+	}
+	envAssert(t, true, found["some-config.protocol"])
+	envAssert(t, false, found["some.config.timeout"])
+	envAssert(t, false, found["some.config.protocol"])
+	envAssert(t, false, found["server.list[2].host"])
+}
@@ -0,0 +1,142 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyNotFoundError is returned by the error-returning getters when none of the configuration
+// sources holds a value for the given key.
+type KeyNotFoundError struct {
+	Key string
+	// Sources holds names of all configuration sources that were consulted, in order of priority
+	Sources []string
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("config: key %s not found in configuration sources [%s]",
+		e.Key, strings.Join(e.Sources, ", "))
+}
+
+// TypeMismatchError is returned by the error-returning getters when a value was found, but could
+// not be converted to the requested type.
+type TypeMismatchError struct {
+	Key    string
+	Source string
+	// Value is the raw value, as returned by the configuration source
+	Value interface{}
+	// Type is the name of the requested type
+	Type string
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("config: value %#v of key %s from source %s cannot be converted to %s",
+		e.Value, e.Key, e.Source, e.Type)
+}
+
+// ConversionError is returned when a value could not be converted to the type of a Bundle field
+// by a converter registered with RegisterConverter, or by field type's UnmarshalText or
+// UnmarshalJSON method.
+type ConversionError struct {
+	Key    string
+	Source string
+	// Value is the raw value, as returned by the configuration source
+	Value interface{}
+	// Type is the name of the field's type
+	Type string
+	Err  error
+}
+
+func (e *ConversionError) Error() string {
+	return fmt.Sprintf("config: value %#v of key %s from source %s cannot be converted to %s: %v",
+		e.Value, e.Key, e.Source, e.Type, e.Err)
+}
+
+// Unwrap returns the error returned by the converter or unmarshaler.
+func (e *ConversionError) Unwrap() error {
+	return e.Err
+}
+
+// RangeError is returned when a numeric value does not fit into the type of a Bundle field (i.e.
+// 300 into an int8 field or -1 into an unsigned field).
+type RangeError struct {
+	Key    string
+	Source string
+	// Value is the raw value, as returned by the configuration source
+	Value interface{}
+	// Type is the name of the field's type
+	Type string
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("config: value %#v of key %s from source %s is out of range for %s",
+		e.Value, e.Key, e.Source, e.Type)
+}
+
+// ValidationError is returned when the value of a Bundle field violates one of the rules of
+// field's validate tag (i.e. 150 with validate:"max=100").
+type ValidationError struct {
+	Key string
+	// Value is the value converted to field's type
+	Value interface{}
+	// Rule is the violated rule, as written in the tag (i.e. "max=100")
+	Rule string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("config: value %#v of key %s violates rule %s", e.Value, e.Key, e.Rule)
+}
+
+// SourceUnavailableError is returned by the error-returning getters when a key was not found and
+// at least one of the configuration sources (i.e. Consul or etcd) could not be queried, meaning
+// the key could have been defined there.
+type SourceUnavailableError struct {
+	Key    string
+	Source string
+	Err    error
+}
+
+func (e *SourceUnavailableError) Error() string {
+	return fmt.Sprintf("config: source %s unavailable while looking up key %s: %v",
+		e.Source, e.Key, e.Err)
+}
+
+// Unwrap returns the underlying error returned by the configuration source.
+func (e *SourceUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// BundleError is returned by NewBundleFromUtil when fields struct could not be filled. It holds
+// errors of all fields that could not be filled.
+type BundleError struct {
+	Errors []error
+}
+
+func (e *BundleError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = strings.TrimPrefix(err.Error(), "config: ")
+	}
+	return fmt.Sprintf("config: bundle could not be filled: %s", strings.Join(msgs, "; "))
+}
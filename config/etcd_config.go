@@ -24,6 +24,8 @@ package config
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"path"
 	"strings"
 	"time"
@@ -35,13 +37,16 @@ import (
 
 type etcdConfigSource struct {
 	client          *client.Client
+	kv              client.KeysAPI
+	transport       *http.Transport
 	startRetryDelay int64
 	maxRetryDelay   int64
 	namespace       string
+	ordinal         int
 	logger          *logm.Logm
 }
 
-func newEtcdConfigSource(conf Util, namespace string, lgr *logm.Logm) configSource {
+func newEtcdConfigSource(conf Util, ext Extension, lgr *logm.Logm) ConfigSource {
 	var etcdConfig etcdConfigSource
 	lgr.Verbose("Initializing %s config source", etcdConfig.Name())
 	etcdConfig.logger = lgr
@@ -52,10 +57,16 @@ func newEtcdConfigSource(conf Util, namespace string, lgr *logm.Logm) configSour
 	} else {
 		etcdAddress = "http://localhost:2379"
 	}
+	// address can be overwritten programmatically by passing it into config.Extension
+	if ext.Hosts != "" {
+		etcdAddress = ext.Hosts
+	}
 
-	if client, err := createEtcdClient(etcdAddress); err == nil {
+	if cl, transport, err := createEtcdClient(etcdAddress); err == nil {
 		lgr.Info("etcd client address set to %v", etcdAddress)
-		etcdConfig.client = client
+		etcdConfig.client = cl
+		etcdConfig.kv = client.NewKeysAPI(*cl)
+		etcdConfig.transport = transport
 	} else {
 		lgr.Error("Failed to create etcd client: %s", err.Error())
 	}
@@ -72,88 +83,231 @@ func newEtcdConfigSource(conf Util, namespace string, lgr *logm.Logm) configSour
 			etcdConfig.namespace = ns
 		}
 	}
-	// ... or programmatically by passing it into config.Options
-	if namespace != "" {
-		etcdConfig.namespace = namespace
+	// ... or programmatically by passing it into config.Options (or config.Extension)
+	if ext.Namespace != "" {
+		etcdConfig.namespace = ext.Namespace
 	}
 
 	lgr.Info("etcd key-value namespace: %s", etcdConfig.namespace)
+	etcdConfig.ordinal = ext.Ordinal
+	if etcdConfig.ordinal == 0 {
+		etcdConfig.ordinal = loadOrdinal(etcdConfig, 150, lgr)
+	}
+
 	lgr.Verbose("Initialized %s config source", etcdConfig.Name())
 	return etcdConfig
 }
 
 func (c etcdConfigSource) Get(key string) interface{} {
-	kv := client.NewKeysAPI(*c.client)
+	val, _, err := c.locate(key)
+	if err != nil {
+		c.logger.Warning("Error getting value: %v", err)
+		return nil
+	}
+	return val
+}
 
-	key = strings.Replace(key, ".", "/", -1)
-	//fmt.Printf("KV path: %s\n", path.Join(c.namespace, key))
+func (c etcdConfigSource) locate(key string) (interface{}, string, error) {
+	kvPath := path.Join(c.namespace, keyToPath(key))
+	//fmt.Printf("KV path: %s\n", kvPath)
 
-	resp, err := kv.Get(context.Background(), path.Join(c.namespace, key), nil)
+	resp, err := c.kv.Get(context.Background(), kvPath, nil)
 	if err != nil {
-		c.logger.Warning("Error getting value: %v", err)
+		if client.IsKeyNotFound(err) {
+			return nil, kvPath, nil
+		}
+		return nil, kvPath, err
+	}
+
+	return resp.Node.Value, kvPath, nil
+}
+
+func (c etcdConfigSource) Keys(prefix string) []string {
+	resp, err := c.kv.Get(context.Background(), path.Join(c.namespace, keyToPath(prefix)),
+		&client.GetOptions{Recursive: true})
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			c.logger.Warning("Error getting keys: %v", err)
+		}
 		return nil
 	}
 
-	return resp.Node.Value
+	// etcd returns absolute paths, i.e. with a leading slash
+	nsPrefix := "/" + strings.Trim(c.namespace, "/") + "/"
+
+	var keys []string
+	var collect func(node *client.Node)
+	collect = func(node *client.Node) {
+		if !node.Dir {
+			keys = append(keys, pathToKey(strings.TrimPrefix(node.Key, nsPrefix)))
+			return
+		}
+		for _, child := range node.Nodes {
+			collect(child)
+		}
+	}
+	collect(resp.Node)
+
+	return keys
+}
+
+func (c etcdConfigSource) listSize(key string) (int, bool) {
+	resp, err := c.kv.Get(context.Background(), path.Join(c.namespace, keyToPath(key)), nil)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			c.logger.Warning("Error getting list size: %v", err)
+		}
+		return 0, false
+	}
+
+	names := make([]string, len(resp.Node.Nodes))
+	for i, node := range resp.Node.Nodes {
+		names[i] = path.Base(node.Key)
+	}
+	return countIndices(names)
 }
 
-func (c etcdConfigSource) Subscribe(key string, callback func(key string, value string)) {
+func (c etcdConfigSource) Subscribe(ctx context.Context, key string, callback func(event ChangeEvent)) {
 	c.logger.Info("Creating a watch for key %s, source: %s", key, c.Name())
-	go c.watch(key, "", c.startRetryDelay, callback)
+	// lists are stored as directories, so watch is recursive to report changes of their elements
+	go c.watch(ctx, key, true, func(event ChangeEvent) {
+		if isKeyOrElement(event.Key, key) {
+			callback(event)
+		}
+	})
+}
+
+func (c etcdConfigSource) SubscribePrefix(ctx context.Context, prefix string, callback func(event ChangeEvent)) {
+	c.logger.Info("Creating a watch for prefix %s, source: %s", prefix, c.Name())
+	go c.watch(ctx, prefix, true, callback)
+}
+
+// Close closes idle connections to etcd. Watches are stopped by canceling their contexts.
+func (c etcdConfigSource) Close() error {
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+	return nil
 }
 
 func (c etcdConfigSource) Name() string {
 	return "etcd"
 }
 
-func (c etcdConfigSource) ordinal() int {
-	return 150
+func (c etcdConfigSource) Ordinal() int {
+	return c.ordinal
 }
 
-// functions that aren't configSource methods
+// functions that aren't ConfigSource methods
+
+// watch watches a single key or, if recursive is true, all keys nested under it
+func (c etcdConfigSource) watch(ctx context.Context, key string, recursive bool, callback func(event ChangeEvent)) {
+	kvPath := path.Join(c.namespace, keyToPath(key))
+	state := watchState{retryDelay: c.startRetryDelay}
 
-func (c etcdConfigSource) watch(key string, previousValue string, retryDelay int64, callback func(key string, value string)) {
+	// etcd returns absolute paths, i.e. with a leading slash
+	nsPrefix := "/" + strings.Trim(c.namespace, "/") + "/"
 
 	c.logger.Verbose("Set a watch on key %s", key)
+	watcher := c.kv.Watcher(kvPath, &client.WatcherOptions{Recursive: recursive})
 
-	key = strings.Replace(key, ".", "/", -1)
-	kv := client.NewKeysAPI(*c.client)
+	for {
+		resp, err := watcher.Next(ctx)
 
-	watcher := kv.Watcher(path.Join(c.namespace, key), nil)
+		// watch was canceled
+		if ctx.Err() != nil {
+			c.logger.Verbose("Watch on key %s canceled", key)
+			return
+		}
 
-	resp, err := watcher.Next(context.Background())
-	if err != nil {
-		c.logger.Warning("Watch on %s failed with error: %s, retry delay: %d ms", key, err.Error(), retryDelay)
+		if err != nil {
+			c.logger.Warning("Watch on %s failed with error: %s, retry delay: %d ms", key, err.Error(), state.retryDelay)
+
+			// sleep for current delay
+			if !sleepContext(ctx, time.Duration(state.retryDelay)*time.Millisecond) {
+				return
+			}
+			state.failed(c.maxRetryDelay)
 
-		// sleep for current delay
-		time.Sleep(time.Duration(retryDelay) * time.Millisecond)
+			// events up to the wait index have been cleared from etcd's history, start over
+			if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeEventIndexCleared {
+				state.waitIndex = 0
+			}
 
-		// exponentially extend retry delay, but keep it at most maxRetryDelay
-		newRetryDelay := retryDelay * 2
-		if newRetryDelay > c.maxRetryDelay {
-			newRetryDelay = c.maxRetryDelay
+			// recreate the watcher, continuing after the last received event
+			c.logger.Verbose("Set a watch on key %s", key)
+			watcher = c.kv.Watcher(kvPath, &client.WatcherOptions{AfterIndex: state.waitIndex, Recursive: recursive})
+			continue
 		}
-		c.watch(key, "", newRetryDelay, callback)
-		return
+
+		c.logger.Verbose("Wait time on watch for key %s reached.", key)
+
+		// changes of directories are only reported when they are deleted, along with all keys in
+		// them
+		if resp.Node.Dir && !isEtcdDeletion(resp.Action) {
+			state.succeeded(resp.Node.ModifiedIndex, c.startRetryDelay)
+			continue
+		}
+
+		event := ChangeEvent{
+			Key:    key,
+			Type:   ChangeUpdated,
+			Source: c.Name(),
+			Index:  resp.Node.ModifiedIndex,
+		}
+		if recursive {
+			event.Key = pathToKey(strings.TrimPrefix(resp.Node.Key, nsPrefix))
+		}
+		if resp.PrevNode != nil && !resp.PrevNode.Dir {
+			event.OldValue = resp.PrevNode.Value
+		}
+		if isEtcdDeletion(resp.Action) {
+			event.Type = ChangeDeleted
+		} else {
+			event.NewValue = resp.Node.Value
+			if resp.PrevNode == nil {
+				event.Type = ChangeCreated
+			}
+		}
+
+		// callbacks are only fired when value changes
+		if event.Type != ChangeUpdated || event.OldValue != event.NewValue {
+			callback(event)
+		}
+		state.succeeded(resp.Node.ModifiedIndex, c.startRetryDelay)
 	}
+}
 
-	c.logger.Verbose("Wait time on watch for key %s reached.", key)
+// functions that aren't ConfigSource methods or etcdCondigSource methods
 
-	if string(resp.Node.Value) != previousValue {
-		callback(key, string(resp.Node.Value))
+// isEtcdDeletion reports whether a watch response action removes a key
+func isEtcdDeletion(action string) bool {
+	switch action {
+	case "delete", "expire", "compareAndDelete":
+		return true
 	}
-	c.watch(key, string(resp.Node.Value), c.startRetryDelay, callback)
+	return false
 }
 
-// functions that aren't configSource methods or etcdCondigSource methods
+func createEtcdClient(address string) (*client.Client, *http.Transport, error) {
+	// same as client.DefaultTransport, but not shared between clients, so that its connections
+	// can be closed
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
 
-func createEtcdClient(address string) (*client.Client, error) {
 	clientConfig := client.Config{}
 	clientConfig.Endpoints = []string{address}
+	clientConfig.Transport = transport
 
 	cl, err := client.New(clientConfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &cl, nil
+	return &cl, transport, nil
 }
@@ -0,0 +1,273 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mc0239/logm"
+	"go.etcd.io/etcd/client"
+)
+
+func etcdAssert(t *testing.T, expected interface{}, got interface{}) {
+	t.Errorf("expected=%v, got=%v", expected, got)
+}
+
+// fakeKeysAPI simulates an etcd key-value store, where every watcher returns a new value on every
+// call of Next, except every 100th call, which fails
+type fakeKeysAPI struct {
+	client.KeysAPI
+	updates  int
+	calls    int
+	watchers int
+	cancel   context.CancelFunc
+}
+
+func (f *fakeKeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	f.watchers++
+	return fakeWatcher{f, key}
+}
+
+type fakeWatcher struct {
+	kv  *fakeKeysAPI
+	key string
+}
+
+func (w fakeWatcher) Next(ctx context.Context) (*client.Response, error) {
+	f := w.kv
+	f.calls++
+	if f.calls > f.updates {
+		f.cancel()
+		return nil, context.Canceled
+	}
+	if f.calls%100 == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &client.Response{
+		Action: "set",
+		Node: &client.Node{
+			Key:           w.key,
+			Value:         strconv.Itoa(f.calls),
+			ModifiedIndex: uint64(f.calls),
+		},
+	}, nil
+}
+
+func TestEtcdConfigWatchLoop(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kv := &fakeKeysAPI{updates: 5000, cancel: cancel}
+	c := etcdConfigSource{kv: kv, namespace: "test", maxRetryDelay: 1, logger: &lgr}
+
+	callbacks := 0
+	stackDepth := 0
+	c.watch(ctx, "some-config.protocol", false, func(event ChangeEvent) {
+		callbacks++
+		// stack must not grow with every update
+		depth := runtime.Callers(0, make([]uintptr, 100))
+		if stackDepth == 0 {
+			stackDepth = depth
+		} else if depth != stackDepth {
+			t.Fatalf("stack depth changed from %d to %d", stackDepth, depth)
+		}
+	})
+
+	// every 100th call failed and watcher was recreated
+	if callbacks != 5000-50 {
+		etcdAssert(t, 5000-50, callbacks)
+	}
+	if kv.watchers != 51 {
+		etcdAssert(t, 51, kv.watchers)
+	}
+}
+
+// scriptedKeysAPI simulates an etcd key-value store, where watchers return given responses, one
+// on every call of Next
+type scriptedKeysAPI struct {
+	client.KeysAPI
+	responses []*client.Response
+	opts      *client.WatcherOptions
+	cancel    context.CancelFunc
+}
+
+func (f *scriptedKeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	f.opts = opts
+	return f
+}
+
+func (f *scriptedKeysAPI) Next(ctx context.Context) (*client.Response, error) {
+	if len(f.responses) == 0 {
+		f.cancel()
+		return nil, context.Canceled
+	}
+	resp := f.responses[0]
+	f.responses = f.responses[1:]
+	return resp, nil
+}
+
+func TestEtcdConfigWatchPrefix(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kv := &scriptedKeysAPI{cancel: cancel, responses: []*client.Response{
+		{Action: "set", Node: &client.Node{Key: "/test/rest-config/routes", Dir: true}},
+		{Action: "set", Node: &client.Node{Key: "/test/rest-config/routes/[0]", Value: "/a"}},
+		{Action: "set", Node: &client.Node{Key: "/test/rest-config/routes/[0]", Value: "/b"},
+			PrevNode: &client.Node{Key: "/test/rest-config/routes/[0]", Value: "/a"}},
+		{Action: "set", Node: &client.Node{Key: "/test/rest-config/routes/[0]", Value: "/b"},
+			PrevNode: &client.Node{Key: "/test/rest-config/routes/[0]", Value: "/b"}},
+		{Action: "delete", Node: &client.Node{Key: "/test/rest-config/port"},
+			PrevNode: &client.Node{Key: "/test/rest-config/port", Value: "8080"}},
+		{Action: "delete", Node: &client.Node{Key: "/test/rest-config/routes", Dir: true}},
+	}}
+	c := etcdConfigSource{kv: kv, namespace: "test", maxRetryDelay: 1, logger: &lgr}
+
+	var changes []string
+	c.SubscribePrefix(ctx, "rest-config", func(event ChangeEvent) {
+		changes = append(changes, event.Type.String()+" "+event.Key+"="+valueString(event.NewValue))
+	})
+	<-ctx.Done()
+
+	if kv.opts == nil || !kv.opts.Recursive {
+		etcdAssert(t, "recursive watcher", kv.opts)
+	}
+	expected := []string{
+		"created rest-config.routes[0]=/a",
+		"updated rest-config.routes[0]=/b",
+		"deleted rest-config.port=",
+		"deleted rest-config.routes=",
+	}
+	if strings.Join(changes, ",") != strings.Join(expected, ",") {
+		etcdAssert(t, expected, changes)
+	}
+}
+
+// storeKeysAPI simulates an etcd key-value store holding given values, where watchers return given
+// responses, one per call of Next, and apply them to the store
+type storeKeysAPI struct {
+	client.KeysAPI
+	mu        sync.Mutex
+	values    map[string]string
+	responses []*client.Response
+	// done is closed when all responses have been returned
+	done chan struct{}
+}
+
+func (f *storeKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key = "/" + strings.Trim(key, "/")
+	if val, ok := f.values[key]; ok {
+		return &client.Response{Node: &client.Node{Key: key, Value: val}}, nil
+	}
+	dir := &client.Node{Key: key, Dir: true}
+	for k, v := range f.values {
+		if strings.HasPrefix(k, key+"/") {
+			dir.Nodes = append(dir.Nodes, &client.Node{Key: k, Value: v})
+		}
+	}
+	if len(dir.Nodes) == 0 {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound}
+	}
+	return &client.Response{Node: dir}, nil
+}
+
+func (f *storeKeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	return f
+}
+
+func (f *storeKeysAPI) Next(ctx context.Context) (*client.Response, error) {
+	f.mu.Lock()
+	if len(f.responses) == 0 {
+		f.mu.Unlock()
+		close(f.done)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	resp := f.responses[0]
+	f.responses = f.responses[1:]
+
+	if isEtcdDeletion(resp.Action) {
+		for k := range f.values {
+			if k == resp.Node.Key || strings.HasPrefix(k, resp.Node.Key+"/") {
+				delete(f.values, k)
+			}
+		}
+	} else {
+		f.values[resp.Node.Key] = resp.Node.Value
+	}
+	f.mu.Unlock()
+	return resp, nil
+}
+
+func TestEtcdConfigWatchPrefixDirectoryDeletion(t *testing.T) {
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+
+	kv := &storeKeysAPI{
+		values: map[string]string{
+			"/test/rest-config/port":       "8080",
+			"/test/rest-config/routes/[0]": "/a",
+			"/test/rest-config/routes/[1]": "/b",
+		},
+		responses: []*client.Response{
+			{Action: "delete", Node: &client.Node{Key: "/test/rest-config/routes", Dir: true, ModifiedIndex: 2}},
+		},
+		done: make(chan struct{}),
+	}
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		Sources:    []ConfigSource{etcdConfigSource{kv: kv, namespace: "test", ordinal: 150, logger: &lgr}},
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	var mu sync.Mutex
+	var changes []string
+	c.WatchPrefix("rest-config", func(event ChangeEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, event.Type.String()+" "+event.Key+"="+valueString(event.OldValue))
+	})
+	<-kv.done
+
+	// every key in the deleted directory is reported
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		"deleted rest-config.routes[0]=/a",
+		"deleted rest-config.routes[1]=/b",
+	}
+	if strings.Join(changes, ",") != strings.Join(expected, ",") {
+		etcdAssert(t, expected, changes)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import "fmt"
+
+// ChangeType describes how a configuration value changed.
+type ChangeType int
+
+const (
+	// ChangeCreated is a change of a key that did not exist before
+	ChangeCreated ChangeType = iota + 1
+	// ChangeUpdated is a change of value of an existing key
+	ChangeUpdated
+	// ChangeDeleted is a removal of a key
+	ChangeDeleted
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeCreated:
+		return "created"
+	case ChangeUpdated:
+		return "updated"
+	case ChangeDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("ChangeType(%d)", int(t))
+}
+
+// ChangeEvent describes a change of a configuration value, delivered to watches created with
+// Util.Watch and Util.WatchPrefix.
+type ChangeEvent struct {
+	// Key is the changed key, in the same (dotted) form as used with Util.Get
+	Key string
+	// OldValue is the value before the change, nil if key was created
+	OldValue interface{}
+	// NewValue is the value after the change, nil if key was deleted
+	NewValue interface{}
+	// Type describes whether key was created, updated or deleted
+	Type ChangeType
+	// Source is the name of the configuration source that supplies the new value, or the one the
+	// key was deleted from
+	Source string
+	// Index is the modify index of the change in the configuration source (i.e. Consul's
+	// ModifyIndex or etcd's modifiedIndex), or 0 if configuration source has no such index
+	Index uint64
+}
+
+// newChangeEvent creates an event of a change from oldValue to newValue, where nil stands for a
+// missing key
+func newChangeEvent(key string, oldValue, newValue interface{}, source string, index uint64) ChangeEvent {
+	changeType := ChangeUpdated
+	if oldValue == nil {
+		changeType = ChangeCreated
+	} else if newValue == nil {
+		changeType = ChangeDeleted
+	}
+	return ChangeEvent{
+		Key:      key,
+		OldValue: oldValue,
+		NewValue: newValue,
+		Type:     changeType,
+		Source:   source,
+		Index:    index,
+	}
+}
+
+// valueString returns a value as passed to callbacks of Util.Subscribe, where deleted keys have an
+// empty value
+func valueString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,178 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// maskedValue replaces values of sensitive keys in explanations
+const maskedValue = "******"
+
+// sensitiveKeyParts are parts of key names which mark the value as sensitive
+var sensitiveKeyParts = []string{"password", "passwd", "secret", "token", "credential", "apikey",
+	"api-key", "private-key", "privatekey"}
+
+// Explanation is a report on how a configuration key is resolved, returned by Util.Explain.
+// Values of sensitive keys (i.e. passwords, secrets, tokens) are masked.
+type Explanation struct {
+	Key string
+	// Found is true if any of the configuration sources holds a value for the key
+	Found bool
+	// Value is the resolved value, as returned by Util.Get
+	Value interface{}
+	// Origin describes the configuration source the resolved value came from
+	Origin Origin
+	// Sources lists all configuration sources in order of priority
+	Sources []SourceExplanation
+}
+
+// SourceExplanation describes the value a single configuration source holds for a key.
+type SourceExplanation struct {
+	Name    string
+	Ordinal int
+	Found   bool
+	Value   interface{}
+	// Key is the physical key that was looked up (or matched, if Found is true)
+	Key string
+	// Err is the error that occurred while querying the source, if any
+	Err error
+	// Candidates lists all names that were tried, for sources that try multiple names for a key
+	// (i.e. environment variables)
+	Candidates []Candidate
+}
+
+// Candidate is one of the names a configuration source tried when looking up a key.
+type Candidate struct {
+	// Kind describes how the name was derived from the key (i.e. raw, normalized, upper, legacy1,
+	// legacy2, indexed)
+	Kind  string
+	Name  string
+	Found bool
+	Value interface{}
+}
+
+// candidateSource is implemented by configuration sources that try multiple names for a key
+type candidateSource interface {
+	candidates(key string) []Candidate
+}
+
+// Explain returns a report of how the given key is resolved: for every configuration source, in
+// order of priority, it lists whether the source holds a value and which value it holds.
+func (c Util) Explain(key string) Explanation {
+	key = c.fullKey(key)
+	sensitive := isSensitiveKey(key)
+	exp := Explanation{
+		Key:     key,
+		Sources: make([]SourceExplanation, 0, len(c.configSources)),
+	}
+	var unavailable error
+
+	for _, cs := range c.configSources {
+		se := SourceExplanation{
+			Name:    cs.Name(),
+			Ordinal: c.ordinalOf(cs),
+			Key:     key,
+		}
+
+		var val interface{}
+		if lcs, ok := cs.(locatingSource); ok {
+			val, se.Key, se.Err = lcs.locate(key)
+			if se.Err != nil && unavailable == nil {
+				unavailable = &SourceUnavailableError{key, se.Name, se.Err}
+			}
+		} else {
+			val = cs.Get(key)
+		}
+		if ccs, ok := cs.(candidateSource); ok {
+			se.Candidates = ccs.candidates(key)
+			for i := range se.Candidates {
+				if sensitive && se.Candidates[i].Found {
+					se.Candidates[i].Value = maskedValue
+				}
+			}
+		}
+
+		if val != nil {
+			se.Found = true
+			se.Value = val
+			if sensitive {
+				se.Value = maskedValue
+			}
+
+			if !exp.Found {
+				exp.Found = true
+				exp.Value = se.Value
+				exp.Origin = Origin{se.Name, se.Ordinal, se.Key, unavailable}
+			}
+		}
+
+		exp.Sources = append(exp.Sources, se)
+	}
+
+	return exp
+}
+
+// String formats the explanation as a human-readable, multi-line report.
+func (e Explanation) String() string {
+	var buf bytes.Buffer
+
+	if e.Found {
+		fmt.Fprintf(&buf, "%s = %v (source: %s, ordinal: %d, key: %s)\n",
+			e.Key, e.Value, e.Origin.Source, e.Origin.Ordinal, e.Origin.Key)
+	} else {
+		fmt.Fprintf(&buf, "%s is not set\n", e.Key)
+	}
+
+	for _, se := range e.Sources {
+		switch {
+		case se.Err != nil:
+			fmt.Fprintf(&buf, "  [%d] %s: error: %v\n", se.Ordinal, se.Name, se.Err)
+		case se.Found:
+			fmt.Fprintf(&buf, "  [%d] %s: %v (key: %s)\n", se.Ordinal, se.Name, se.Value, se.Key)
+		default:
+			fmt.Fprintf(&buf, "  [%d] %s: not set\n", se.Ordinal, se.Name)
+		}
+
+		for _, cand := range se.Candidates {
+			if cand.Found {
+				fmt.Fprintf(&buf, "        %-10s %s = %v\n", cand.Kind, cand.Name, cand.Value)
+			} else {
+				fmt.Fprintf(&buf, "        %-10s %s not set\n", cand.Kind, cand.Name)
+			}
+		}
+	}
+
+	return buf.String()
+}
+
+func isSensitiveKey(key string) bool {
+	lkey := strings.ToLower(key)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(lkey, part) {
+			return true
+		}
+	}
+	return false
+}
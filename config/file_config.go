@@ -22,23 +22,47 @@
 package config
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/ghodss/yaml"
 	"github.com/mc0239/logm"
 )
 
+// filePollInterval is the interval of checking configuration file for changes, when file system
+// notifications are not available
+var filePollInterval = 5 * time.Second
+
 type fileConfigSource struct {
-	config map[string]interface{}
-	logger *logm.Logm
+	path    string
+	config  *fileConfig
+	ordinal int
+	// subscriptions are served by a single watch on the configuration file
+	subscriptions *subscriptionRegistry
+	logger        *logm.Logm
+}
+
+// fileConfig holds parsed configuration file, which is replaced when file changes
+type fileConfig struct {
+	mu   sync.RWMutex
+	tree map[string]interface{}
+	// raw content of the file, used to detect changes
+	content []byte
 }
 
-func newFileConfigSource(configPath string, lgr *logm.Logm) configSource {
+func newFileConfigSource(configPath string, lgr *logm.Logm) ConfigSource {
 	var c fileConfigSource
 	lgr.Verbose("Initializing %s config source", c.Name())
 	c.logger = lgr
+	c.subscriptions = newSubscriptionRegistry()
 
 	var joinedPath string
 	if configPath == "" {
@@ -47,6 +71,7 @@ func newFileConfigSource(configPath string, lgr *logm.Logm) configSource {
 	} else {
 		joinedPath = configPath
 	}
+	c.path = joinedPath
 
 	lgr.Verbose(fmt.Sprintf("Config file path: %s\n", joinedPath))
 
@@ -57,48 +82,233 @@ func newFileConfigSource(configPath string, lgr *logm.Logm) configSource {
 	}
 	//fmt.Printf("Read: %s", bytes)
 
-	err = yaml.Unmarshal(bytes, &c.config)
+	c.config = &fileConfig{content: bytes}
+	err = yaml.Unmarshal(bytes, &c.config.tree)
 	if err != nil {
 		lgr.Error(fmt.Sprintf("Failed tu unmarshal yaml: %s", err.Error()))
 		return nil
 	}
 
+	c.ordinal = loadOrdinal(c, 100, lgr)
+
 	lgr.Verbose("Initialized %s config source", c.Name())
 	return c
 }
 
 func (c fileConfigSource) Get(key string) interface{} {
 	//fmt.Println("[fileConfigSource] Get: " + key)
-	tree := strings.Split(key, ".")
+	return getTreeValue(c.tree(), key)
+}
 
-	// move deeper into maps for every dot delimiter
-	val := c.config
-	var assertOk bool
-	for i := 0; i < len(tree)-1; i++ {
-		if val == nil {
-			return nil
-		}
-		val, assertOk = val[tree[i]].(map[string]interface{})
+func (c fileConfigSource) Keys(prefix string) []string {
+	if prefix == "" {
+		return flattenValue("", c.tree(), nil)
+	}
+	return flattenValue(prefix, c.Get(prefix), nil)
+}
 
-		if !assertOk {
-			return nil
-		}
-		//fmt.Printf("%d ::: %v\n", i, val)
+func (c fileConfigSource) listSize(key string) (int, bool) {
+	if list, ok := c.Get(key).([]interface{}); ok {
+		return len(list), true
 	}
+	return 0, false
+}
 
-	return val[tree[len(tree)-1]]
+func (c fileConfigSource) Subscribe(ctx context.Context, key string, callback func(event ChangeEvent)) {
+	c.logger.Info("Creating a watch: key=%s. path=%s source=%s", key, c.path, c.Name())
+	if loopCtx, start := c.subscriptions.add(ctx, key, false, callback); start {
+		go c.watch(loopCtx)
+	}
 }
 
-func (c fileConfigSource) Subscribe(key string, callback func(key string, value string)) {
-	return
+func (c fileConfigSource) SubscribePrefix(ctx context.Context, prefix string, callback func(event ChangeEvent)) {
+	c.logger.Info("Creating a watch: prefix=%s. path=%s source=%s", prefix, c.path, c.Name())
+	if loopCtx, start := c.subscriptions.add(ctx, prefix, true, callback); start {
+		go c.watch(loopCtx)
+	}
 }
 
 func (c fileConfigSource) Name() string {
 	return "file"
 }
 
-func (c fileConfigSource) ordinal() int {
-	return 100
+func (c fileConfigSource) Ordinal() int {
+	return c.ordinal
 }
 
-//
+// functions that aren't ConfigSource methods
+
+func (c fileConfigSource) tree() map[string]interface{} {
+	c.config.mu.RLock()
+	defer c.config.mu.RUnlock()
+	return c.config.tree
+}
+
+// watch reloads configuration file whenever it changes, until ctx is done. File system
+// notifications are used if available, otherwise file is polled.
+func (c fileConfigSource) watch(ctx context.Context) {
+	if err := c.watchNotify(ctx); err != nil {
+		c.logger.Warning("File system notifications for %s are not available: %s, polling every %s", c.path, err.Error(), filePollInterval)
+		c.watchPoll(ctx)
+	}
+}
+
+// watchNotify watches directories of configuration file (and of its target, if it is a symbolic
+// link), so that atomic replacements of the file or of symbolic links pointing to it (i.e. updates
+// of Kubernetes ConfigMaps) are noticed as well. It returns an error if watch could not be set up
+// or has failed.
+func (c fileConfigSource) watchNotify(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watched := make(map[string]bool)
+	watchDirs := func() error {
+		dirs := []string{filepath.Dir(c.path)}
+		if target, err := filepath.EvalSymlinks(c.path); err == nil {
+			dirs = append(dirs, filepath.Dir(target))
+		}
+		for _, dir := range dirs {
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				return err
+			}
+			watched[dir] = true
+		}
+		return nil
+	}
+	if err := watchDirs(); err != nil {
+		return err
+	}
+
+	c.logger.Verbose("Set a watch on file %s", c.path)
+	// file may have changed before the watch was set
+	c.reload()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.logger.Verbose("Watch on file %s canceled", c.path)
+			return nil
+		case err := <-watcher.Errors:
+			return err
+		case <-watcher.Events:
+			// events are not filtered by name, since file may change through symbolic links
+			c.reload()
+			// symbolic link may point to a new directory
+			if err := watchDirs(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watchPoll checks configuration file for changes every filePollInterval, until ctx is done
+func (c fileConfigSource) watchPoll(ctx context.Context) {
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.logger.Verbose("Watch on file %s canceled", c.path)
+			return
+		case <-ticker.C:
+			c.reload()
+		}
+	}
+}
+
+// reload reads and parses configuration file if its content changed and dispatches changed values
+// to subscriptions. If file is empty or can not be read or parsed, previous configuration is kept.
+func (c fileConfigSource) reload() {
+	content, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		// file may be missing for a moment while it is being replaced
+		c.logger.Warning("Failed to read file on path: %s, error: %s", c.path, err.Error())
+		return
+	}
+
+	if len(bytes.TrimSpace(content)) == 0 {
+		// file is truncated for a moment while it is being rewritten in place
+		c.logger.Verbose("File on path %s is empty, keeping previous configuration", c.path)
+		return
+	}
+
+	c.config.mu.RLock()
+	unchanged := bytes.Equal(content, c.config.content)
+	c.config.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(content, &tree); err != nil {
+		c.logger.Warning("Failed to unmarshal changed yaml: %s", err.Error())
+		return
+	}
+	c.logger.Info("Configuration file %s changed, reloading", c.path)
+
+	c.config.mu.Lock()
+	previous := c.config.tree
+	c.config.tree = tree
+	c.config.content = content
+	c.config.mu.Unlock()
+
+	for _, event := range diffTrees(previous, tree, c.Name()) {
+		c.subscriptions.dispatch(event)
+	}
+}
+
+// functions that aren't ConfigSource methods or fileConfigSource methods
+
+// getTreeValue returns the value for a given key from a parsed configuration file, moving deeper
+// into maps for every dot delimiter and into lists for every index
+func getTreeValue(tree map[string]interface{}, key string) interface{} {
+	var val interface{} = tree
+
+	for _, segment := range strings.Split(key, ".") {
+		name, indices := splitKeyIndices(segment)
+
+		m, assertOk := val.(map[string]interface{})
+		if !assertOk {
+			return nil
+		}
+		val = m[name]
+
+		for _, i := range indices {
+			list, assertOk := val.([]interface{})
+			if !assertOk || i >= len(list) {
+				return nil
+			}
+			val = list[i]
+		}
+	}
+
+	return val
+}
+
+// diffTrees returns change events for all keys that were created, updated or deleted between two
+// parsed configuration files
+func diffTrees(previous, current map[string]interface{}, source string) []ChangeEvent {
+	var events []ChangeEvent
+
+	for _, key := range flattenValue("", current, nil) {
+		newValue := getTreeValue(current, key)
+		oldValue := getTreeValue(previous, key)
+		if !reflect.DeepEqual(oldValue, newValue) {
+			events = append(events, newChangeEvent(key, oldValue, newValue, source, 0))
+		}
+	}
+	for _, key := range flattenValue("", previous, nil) {
+		if getTreeValue(current, key) == nil {
+			events = append(events, newChangeEvent(key, getTreeValue(previous, key), nil, source, 0))
+		}
+	}
+
+	return events
+}
@@ -22,7 +22,16 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mc0239/logm"
 )
 
 func fileAssert(t *testing.T, expected interface{}, got interface{}) {
@@ -175,3 +184,348 @@ func TestFileConfigDeep(t *testing.T) {
 		fileAssert(t, 6, i)
 	}
 }
+
+func TestFileConfigGetE(t *testing.T) {
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	if i, err := c.GetIntE("integer-value"); !(err == nil && i == 36) {
+		fileAssert(t, 36, i)
+	}
+
+	_, err := c.GetIntE("string-value")
+	if tmErr, ok := err.(*TypeMismatchError); !ok {
+		fileAssert(t, "*TypeMismatchError", err)
+	} else if tmErr.Key != "string-value" || tmErr.Source != "file" || tmErr.Value != "hey ho" {
+		fileAssert(t, "string-value/file/hey ho", tmErr)
+	}
+
+	_, err = c.GetStringE("non-existent-value")
+	if nfErr, ok := err.(*KeyNotFoundError); !ok {
+		fileAssert(t, "*KeyNotFoundError", err)
+	} else if nfErr.Key != "non-existent-value" || len(nfErr.Sources) != 2 {
+		fileAssert(t, "non-existent-value/[env file]", nfErr)
+	}
+}
+
+func TestFileConfigGetDuration(t *testing.T) {
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	if d, ok := c.GetDuration("duration-value"); !(ok && d == 90*time.Second) {
+		fileAssert(t, 90*time.Second, d)
+	}
+	if d, ok := c.GetDuration("iso-duration-value"); !(ok && d == 90*time.Second) {
+		fileAssert(t, 90*time.Second, d)
+	}
+	if d, ok := c.GetDuration("numeric-duration-value"); !(ok && d == 1500*time.Millisecond) {
+		fileAssert(t, 1500*time.Millisecond, d)
+	}
+	if d, ok := c.GetDuration("string-value"); !(!ok && d == 0) {
+		fileAssert(t, 0, d)
+	}
+
+	c = NewUtil(Options{
+		ConfigPath:   "../test/config.yaml",
+		DurationUnit: time.Second,
+		LogLevel:     100, // turn off logging
+	})
+	if d, ok := c.GetDuration("numeric-duration-value"); !(ok && d == 1500*time.Second) {
+		fileAssert(t, 1500*time.Second, d)
+	}
+}
+
+func TestFileConfigBundleDuration(t *testing.T) {
+	type durationConfig struct {
+		Duration        time.Duration `config:"duration-value"`
+		ISODuration     time.Duration `config:"iso-duration-value"`
+		NumericDuration time.Duration `config:"numeric-duration-value"`
+	}
+
+	dc := durationConfig{}
+
+	NewBundle("", &dc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	if dc.Duration != 90*time.Second {
+		fileAssert(t, 90*time.Second, dc.Duration)
+	}
+	if dc.ISODuration != 90*time.Second {
+		fileAssert(t, 90*time.Second, dc.ISODuration)
+	}
+	if dc.NumericDuration != 1500*time.Millisecond {
+		fileAssert(t, 1500*time.Millisecond, dc.NumericDuration)
+	}
+}
+
+func TestFileConfigList(t *testing.T) {
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+	if n, ok := c.GetListSize("yaml-array"); !(ok && n == 4) {
+		fileAssert(t, 4, n)
+	}
+	if s, ok := c.GetString("yaml-array[1]"); !(ok && s == "entry2") {
+		fileAssert(t, "entry2", s)
+	}
+	if s, ok := c.GetString("server-list[1].host"); !(ok && s == "b.example.com") {
+		fileAssert(t, "b.example.com", s)
+	}
+	if s, ok := c.GetString("server-list[2].host"); ok {
+		fileAssert(t, "", s)
+	}
+	if s, ok := c.GetStringSlice("yaml-array"); !(ok && len(s) == 4 && s[3] == "entry4") {
+		fileAssert(t, []string{"entry1", "entry2", "entry3", "entry4"}, s)
+	}
+	if i, ok := c.GetIntSlice("int-array"); !(ok && len(i) == 3 && i[0] == 1 && i[2] == 3) {
+		fileAssert(t, []int{1, 2, 3}, i)
+	}
+	if i, ok := c.GetIntSlice("yaml-array"); ok {
+		fileAssert(t, nil, i)
+	}
+}
+
+func TestFileConfigBundleList(t *testing.T) {
+	type listConfig struct {
+		Entries []string `config:"yaml-array"`
+		Ints    []int    `config:"int-array"`
+		Servers []struct {
+			Host string
+			Port int
+		} `config:"server-list"`
+	}
+
+	lc := listConfig{}
+
+	NewBundle("", &lc, Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	if len(lc.Entries) != 4 || lc.Entries[0] != "entry1" {
+		fileAssert(t, []string{"entry1", "entry2", "entry3", "entry4"}, lc.Entries)
+	}
+	if len(lc.Ints) != 3 || lc.Ints[1] != 2 {
+		fileAssert(t, []int{1, 2, 3}, lc.Ints)
+	}
+	if len(lc.Servers) != 2 || lc.Servers[1].Host != "b.example.com" || lc.Servers[1].Port != 8081 {
+		fileAssert(t, "2 servers", lc.Servers)
+	}
+}
+
+func TestFileConfigGetMap(t *testing.T) {
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	m, ok := c.GetMap("some-config")
+	if !ok || m["protocol"] != "tcp" || m["some-boolean"] != true {
+		fileAssert(t, "some-config map", m)
+	}
+	if address, ok := m["address"].(map[string]interface{}); !ok || address["ip"] != "127.0.0.2" {
+		fileAssert(t, "address map", m["address"])
+	}
+
+	if m, ok := c.GetMap("server-list"); ok {
+		// list is not a map
+		fileAssert(t, nil, m)
+	}
+	if m, ok := c.GetMap("server-list[1]"); !(ok && m["host"] == "b.example.com") {
+		fileAssert(t, "server-list[1] map", m)
+	}
+
+	if m, ok := c.GetMap("non-existent"); ok {
+		fileAssert(t, nil, m)
+	}
+}
+
+func TestFileConfigSub(t *testing.T) {
+	c := NewUtil(Options{
+		ConfigPath: "../test/config.yaml",
+		LogLevel:   100, // turn off logging
+	})
+
+	sub := c.Sub("some-config")
+	if s, ok := sub.GetString("protocol"); !(ok && s == "tcp") {
+		fileAssert(t, "tcp", s)
+	}
+	if i, ok := sub.Sub("address").GetInt("port"); !(ok && i == 3000) {
+		fileAssert(t, 3000, i)
+	}
+	if m, ok := sub.GetMap("address"); !(ok && m["ip"] == "127.0.0.2") {
+		fileAssert(t, "address map", m)
+	}
+	if s, ok := c.Sub("server-list[1]").GetString("host"); !(ok && s == "b.example.com") {
+		fileAssert(t, "b.example.com", s)
+	}
+}
+
+// writeFile writes content to a file, failing the test on error
+func writeFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectChange waits for a change event, formatted as "<type> <key>=<new value>"
+func expectChange(t *testing.T, changes chan string, expected string) {
+	select {
+	case change := <-changes:
+		if change != expected {
+			fileAssert(t, expected, change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected change %s, got none", expected)
+	}
+}
+
+func TestFileConfigHotReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, "rest-config:\n  port: 8080\n  host: localhost\n")
+
+	c := NewUtil(Options{
+		ConfigPath: path,
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	changes := make(chan string, 10)
+	c.WatchPrefix("rest-config", func(event ChangeEvent) {
+		changes <- fmt.Sprintf("%s %s=%v", event.Type, event.Key, event.NewValue)
+	})
+
+	writeFile(t, path, "rest-config:\n  port: 9090\n  host: localhost\n")
+	expectChange(t, changes, "updated rest-config.port=9090")
+
+	writeFile(t, path, "rest-config:\n  port: 9090\n")
+	expectChange(t, changes, "deleted rest-config.host=<nil>")
+
+	if i, ok := c.GetInt("rest-config.port"); !(ok && i == 9090) {
+		fileAssert(t, 9090, i)
+	}
+}
+
+func TestFileConfigWatchedBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, "rest:\n  port: 8080\n  routes:\n    - /a\n")
+
+	c := NewUtil(Options{
+		ConfigPath: path,
+		Snapshots:  true,
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	type restConfig struct {
+		Port   int      `config:"port,watch"`
+		Routes []string `config:"routes,watch"`
+	}
+	bun, _ := NewBundleFromUtil(c, "rest", &restConfig{})
+
+	changes := make(chan string, 10)
+	bun.OnChange(func(changedFields []string) {
+		changes <- strings.Join(changedFields, ",")
+	})
+
+	// lists are updated when any of their elements changes
+	writeFile(t, path, "rest:\n  port: 8080\n  routes:\n    - /a\n    - /b\n")
+	select {
+	case field := <-changes:
+		if field != "Routes" {
+			fileAssert(t, "Routes", field)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected change of Routes, got none")
+	}
+	if routes := strings.Join(bun.Current().(*restConfig).Routes, ","); routes != "/a,/b" {
+		fileAssert(t, "/a,/b", routes)
+	}
+}
+
+func TestFileConfigSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// layout of a Kubernetes ConfigMap volume
+	os.Mkdir(filepath.Join(dir, "..v1"), 0755)
+	writeFile(t, filepath.Join(dir, "..v1", "config.yaml"), "timeout: 30\n")
+	os.Symlink("..v1", filepath.Join(dir, "..data"))
+	os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml"))
+
+	c := NewUtil(Options{
+		ConfigPath: filepath.Join(dir, "config.yaml"),
+		LogLevel:   100, // turn off logging
+	})
+	defer c.Close()
+
+	changes := make(chan string, 10)
+	c.Watch("timeout", func(event ChangeEvent) {
+		changes <- fmt.Sprintf("%s %s=%v", event.Type, event.Key, event.NewValue)
+	})
+
+	// ConfigMap is updated by atomically replacing ..data symbolic link
+	os.Mkdir(filepath.Join(dir, "..v2"), 0755)
+	writeFile(t, filepath.Join(dir, "..v2", "config.yaml"), "timeout: 60\n")
+	os.Symlink("..v2", filepath.Join(dir, "..data_tmp"))
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(dir, "..v1"))
+
+	expectChange(t, changes, "updated timeout=60")
+}
+
+func TestFileConfigPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, "timeout: 30\n")
+
+	lgr := logm.New("KumuluzEE-config")
+	lgr.LogLevel = 100 // turn off logging
+	c := newFileConfigSource(path, &lgr).(fileConfigSource)
+
+	defer func(interval time.Duration) { filePollInterval = interval }(filePollInterval)
+	filePollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 10)
+	c.subscriptions.add(ctx, "timeout", false, func(event ChangeEvent) {
+		changes <- fmt.Sprintf("%s %s=%v", event.Type, event.Key, event.NewValue)
+	})
+	go c.watchPoll(ctx)
+
+	// invalid content is ignored
+	writeFile(t, path, "timeout: [\n")
+	writeFile(t, path, "timeout: 60\n")
+	expectChange(t, changes, "updated timeout=60")
+	if v := c.Get("timeout"); v != float64(60) {
+		fileAssert(t, 60, v)
+	}
+}
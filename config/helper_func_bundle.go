@@ -22,95 +22,425 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"reflect"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
-func traverseStruct(s interface{}, prefixKey string, fieldProcessFunc func(key string, value reflect.Value, field reflect.StructField, tags reflect.StructTag)) {
+func traverseStruct(s interface{}, prefixKey string, allocate func(key string, field reflect.StructField) bool, fieldProcessFunc func(key string, value reflect.Value, field reflect.StructField, tags reflect.StructTag)) {
 	// passed value is not of type reflect.Value?
 	// I will make passed value of type reflect.Value
-	var val reflect.Value
-	var valType reflect.Type
 	val, ok := s.(reflect.Value)
 	if !ok {
 		val = reflect.ValueOf(s).Elem()
 	}
-	valType = val.Type()
+	traverseStructIndex(val, prefixKey, nil, allocate, fieldProcessFunc)
+}
+
+// traverseStructIndex traverses a struct value, same as traverseStruct. Index of every processed
+// field is the index sequence from the traversed struct (i.e. for use with FieldByIndex), rather
+// than from the struct that field is declared in.
+// Nested pointers to structs are traversed as well. Nil pointers are allocated if allocate returns
+// true for them and are skipped otherwise.
+func traverseStructIndex(val reflect.Value, prefixKey string, index []int, allocate func(key string, field reflect.StructField) bool, fieldProcessFunc func(key string, value reflect.Value, field reflect.StructField, tags reflect.StructTag)) {
+	valType := val.Type()
 
 	// iterate through fields (assuming passed value was struct pointer!)
 	for i := 0; i < val.NumField(); i++ {
 		field := val.Field(i)
+		structField := valType.Field(i)
+		structField.Index = append(append([]int{}, index...), i)
 		//fieldName := valType.Field(i).Name
-		fieldTags := valType.Field(i).Tag
+		fieldTags := structField.Tag
+
+		key := retrieveKey(prefixKey, structField, fieldTags)
+		// embedded structs are squashed into the parent, unless they are named with config tag or
+		// tagged with config:",nosquash"
+		if structField.Anonymous && isNestedStruct(structField.Type) &&
+			strings.Split(fieldTags.Get("config"), ",")[0] == "" && !hasTagOption(fieldTags, "nosquash") {
+			key = prefixKey
+		}
 
-		key := retrieveKey(prefixKey, valType.Field(i), fieldTags)
 		// if field is a struct, recursively call function to traverse all nested structs aswell
-		if field.Kind() == reflect.Struct {
-			traverseStruct(field, key, fieldProcessFunc)
-		} else {
-			// field processing is only done on fields that aren't nested structs
+		if isNestedStruct(field.Type()) {
+			if field.Kind() == reflect.Ptr {
+				if field.IsNil() {
+					if allocate == nil || !field.CanSet() || !allocate(key, structField) {
+						continue
+					}
+					field.Set(reflect.New(field.Type().Elem()))
+				}
+				field = field.Elem()
+			}
+			traverseStructIndex(field, key, structField.Index, allocate, fieldProcessFunc)
+		} else if field.CanSet() {
+			// field processing is only done on fields that aren't nested structs and can be set
+			// (unexported fields are skipped)
 			if fieldProcessFunc != nil {
-				fieldProcessFunc(key, field, valType.Field(i), fieldTags)
+				fieldProcessFunc(key, field, structField, fieldTags)
 			}
 		}
 	}
 }
 
+// isNestedStruct reports whether fields of type t are traversed as nested structs, which are
+// structs and pointers to structs, unless they are filled as a whole (i.e. time.Time, which
+// implements encoding.TextUnmarshaler)
+func isNestedStruct(t reflect.Type) bool {
+	if isConvertible(t) {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// allocateAcyclic returns an allocate function for traverseStruct, which allocates all nil
+// pointers to structs within a struct of type root, except for pointers to structs that are
+// already being traversed (i.e. linked lists), which would never end
+func allocateAcyclic(root reflect.Type) func(key string, field reflect.StructField) bool {
+	return func(key string, field reflect.StructField) bool {
+		t := root
+		for _, i := range field.Index {
+			if t == field.Type.Elem() {
+				return false
+			}
+			t = t.Field(i).Type
+			if t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+		}
+		return true
+	}
+}
+
+// allocateExisting returns an allocate function for traverseStruct, which allocates nil pointers
+// to structs if any configuration source holds a value for any of their fields
+func allocateExisting(bun Bundle) func(key string, field reflect.StructField) bool {
+	return func(key string, field reflect.StructField) bool {
+		return structHasValues(key, field.Type.Elem(), bun)
+	}
+}
+
+// structHasValues reports whether any configuration source holds a value for any field of a
+// struct of type t under a given key
+func structHasValues(key string, t reflect.Type, bun Bundle) bool {
+	found := false
+	// not all configuration sources list their keys, so fields are looked up one by one
+	traverseStruct(reflect.New(t).Elem(), key, allocateAcyclic(t),
+		func(fieldKey string, value reflect.Value, field reflect.StructField, tags reflect.StructTag) {
+			if !found && checkRequired(fieldKey, value, bun) == nil {
+				found = true
+			}
+		},
+	)
+	return found
+}
+
+// copyStruct returns a pointer to a shallow copy of the struct that ptr points to
+func copyStruct(ptr reflect.Value) reflect.Value {
+	c := reflect.New(ptr.Elem().Type())
+	c.Elem().Set(ptr.Elem())
+	return c
+}
+
+// fieldPath returns the path of a field, given by its index sequence, i.e. "RestConfig.Port"
+func fieldPath(t reflect.Type, index []int) string {
+	names := make([]string, len(index))
+	for i, fieldIndex := range index {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		field := t.Field(fieldIndex)
+		names[i] = field.Name
+		t = field.Type
+	}
+	return strings.Join(names, ".")
+}
+
+// fieldByIndexCopy returns the nested field of struct v given by its index sequence, same as
+// FieldByIndex. Pointers to structs on the way are replaced by pointers to their copies, so that
+// the returned field can be modified without modifying structs shared with other copies of v.
+func fieldByIndexCopy(v reflect.Value, index []int) reflect.Value {
+	for i, fieldIndex := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			c := copyStruct(v)
+			v.Set(c)
+			v = c.Elem()
+		}
+		v = v.Field(fieldIndex)
+	}
+	return v
+}
+
+// valueInterface returns the value held by v, or nil if it can not be accessed (i.e. unexported
+// fields)
+func valueInterface(v reflect.Value) interface{} {
+	if !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// hasTagOption reports whether config tag of a field holds a given option after the key, i.e.
+// "watch" in config:"port,watch,required"
+func hasTagOption(tags reflect.StructTag, option string) bool {
+	tag, ok := tags.Lookup("config")
+	if !ok {
+		return false
+	}
+	for _, tagVal := range strings.Split(tag, ",")[1:] {
+		if strings.TrimSpace(tagVal) == option {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequired returns a KeyNotFoundError if no configuration source holds a value for a
+// required field
+func checkRequired(key string, value reflect.Value, bun Bundle) error {
+	// lists may only be defined by their elements (i.e. key[0])
+	if value.Kind() == reflect.Slice {
+		if _, ok := bun.conf.GetListSize(key); ok {
+			return nil
+		}
+	}
+	_, err := bun.conf.GetE(key)
+	if _, ok := err.(*KeyNotFoundError); ok {
+		return err
+	}
+	return nil
+}
+
 func retrieveKey(prefixKey string, field reflect.StructField, tags reflect.StructTag) string {
 	// building key: if config tag is defined and has non-empty first value,
 	// use prefixKey + tag, otherwise, use prefixKey + lowercased field name
 	var key string
 
-	if tag, ok := tags.Lookup("config"); ok {
-		tvs := strings.Split(tag, ",")
-		if tvs[0] != "" {
-			key = prefixKey + "." + tvs[0]
-		}
+	if tag := strings.Split(tags.Get("config"), ","); tag[0] != "" {
+		key = joinKey(prefixKey, tag[0])
 	} else {
 		r, n := utf8.DecodeRuneInString(field.Name)
 		lkey := string(unicode.ToLower(r)) + field.Name[n:]
-		key = prefixKey + "." + lkey
+		key = joinKey(prefixKey, lkey)
 	}
 
 	return key
 }
 
-func setValueWithReflect(key string, value reflect.Value, field reflect.StructField, bun Bundle) {
-	switch field.Type.Kind() {
+// fillField fills a field like setValueWithReflect, but if field has a validate tag, the new value
+// is checked against its rules before it is set. Field is left unchanged if the value violates any
+// of the rules.
+func fillField(key string, value reflect.Value, field reflect.StructField, tags reflect.StructTag, bun Bundle) error {
+	rules, ok := tags.Lookup("validate")
+	if !ok {
+		return setValueWithReflect(key, value, field, bun)
+	}
+	// values that are not set by configuration are not validated
+	if checkRequired(key, value, bun) != nil {
+		return nil
+	}
+
+	candidate := reflect.New(value.Type()).Elem()
+	candidate.Set(value)
+	if err := setValueWithReflect(key, candidate, field, bun); err != nil {
+		return err
+	}
+	if err := validateField(bun.conf.fullKey(key), candidate, rules, bun.conf.durationUnit); err != nil {
+		return err
+	}
+	value.Set(candidate)
+	return nil
+}
+
+// setValueWithReflect fills a field with the value of a given key. Field is left unchanged if key
+// does not exist, and an error is returned if value could not be converted to field's type.
+func setValueWithReflect(key string, value reflect.Value, field reflect.StructField, bun Bundle) error {
+	// registered converters and unmarshalers take precedence over kinds (i.e. net.IP is a slice)
+	if isConvertible(value.Type()) {
+		return setConvertedWithReflect(key, value, bun)
+	}
+
+	// time.Duration is of kind int64, but is not filled as an integer
+	if value.Type() == durationType {
+		val, err := bun.conf.GetDurationE(key)
+		if err == nil {
+			value.SetInt(int64(val))
+		}
+		return fieldError(err)
+	}
+
+	switch value.Kind() {
 	case reflect.Bool:
-		if val, ok := bun.conf.GetBool(key); ok {
+		val, err := bun.conf.GetBoolE(key)
+		if err == nil {
 			value.Set(reflect.ValueOf(val))
 		}
-		break
+		return fieldError(err)
 	case reflect.String:
-		if val, ok := bun.conf.GetString(key); ok {
+		val, err := bun.conf.GetStringE(key)
+		if err == nil {
 			value.Set(reflect.ValueOf(val))
 		}
-		break
-	case reflect.Int:
-		fallthrough
-	case reflect.Int8:
-		fallthrough
-	case reflect.Int16:
-		fallthrough
-	case reflect.Int32:
-		fallthrough
-	case reflect.Int64:
-		if val, ok := bun.conf.GetInt(key); ok {
-			value.Set(reflect.ValueOf(val))
+		return fieldError(err)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return setNumberWithReflect(key, value, bun)
+	case reflect.Slice:
+		size, ok := bun.conf.GetListSize(key)
+		if !ok {
+			return nil
 		}
-		break
-	case reflect.Float32:
-		fallthrough
-	case reflect.Float64:
-		if val, ok := bun.conf.GetFloat(key); ok {
-			value.Set(reflect.ValueOf(val))
+
+		// fill every element using index syntax, i.e. key[0]
+		var firstErr error
+		slice := reflect.MakeSlice(value.Type(), size, size)
+		for i := 0; i < size; i++ {
+			elem := slice.Index(i)
+			var err error
+			if elem.Kind() == reflect.Struct && !isConvertible(elem.Type()) {
+				err = fillStruct(indexKey(key, i), elem, bun)
+			} else {
+				err = setValueWithReflect(indexKey(key, i), elem, field, bun)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return firstErr
 		}
-		break
+		value.Set(slice)
+		return nil
+	case reflect.Ptr:
+		// pointers are left nil if key does not exist, so that unset fields can be told apart from
+		// zero values
+		elem := reflect.New(value.Type().Elem())
+		if elem.Elem().Kind() == reflect.Struct {
+			if !structHasValues(key, elem.Elem().Type(), bun) {
+				return nil
+			}
+			if err := fillStruct(key, elem.Elem(), bun); err != nil {
+				return err
+			}
+		} else {
+			if checkRequired(key, elem.Elem(), bun) != nil {
+				return nil
+			}
+			if err := setValueWithReflect(key, elem.Elem(), field, bun); err != nil {
+				return err
+			}
+		}
+		value.Set(elem)
+		return nil
 	default:
-		bun.Logger.Warning("Field %s could not be properly reflected, ignoring.", key)
-		break
+		return fmt.Errorf("config: field %s of type %s is not supported", key, value.Type())
 	}
 }
+
+// fillStruct fills all fields of a struct value (i.e. an element of a slice of structs) and returns
+// the first error
+func fillStruct(key string, value reflect.Value, bun Bundle) error {
+	var err error
+	traverseStruct(value, key, allocateExisting(bun),
+		func(fieldKey string, fieldValue reflect.Value, field reflect.StructField, tags reflect.StructTag) {
+			if fieldErr := setValueWithReflect(fieldKey, fieldValue, field, bun); err == nil {
+				err = fieldErr
+			}
+		},
+	)
+	return err
+}
+
+// setNumberWithReflect fills a field of any integer or float kind. Values that do not fit into
+// field's type are rejected with a RangeError, rather than wrapped around.
+func setNumberWithReflect(key string, value reflect.Value, bun Bundle) error {
+	rvalue, origin, err := bun.conf.lookup(key)
+	if err != nil {
+		return fieldError(err)
+	}
+	fullKey := bun.conf.fullKey(key)
+
+	switch value.Kind() {
+	case reflect.Float32, reflect.Float64:
+		fvalue, ok := convertFloat(rvalue)
+		if !ok {
+			return &TypeMismatchError{fullKey, origin.Source, rvalue, value.Type().String()}
+		}
+		if value.OverflowFloat(fvalue) {
+			return &RangeError{fullKey, origin.Source, rvalue, value.Type().String()}
+		}
+		value.SetFloat(fvalue)
+		return nil
+	}
+
+	ivalue, ok := convertBigInt(rvalue)
+	if !ok {
+		return &TypeMismatchError{fullKey, origin.Source, rvalue, value.Type().String()}
+	}
+
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !ivalue.IsInt64() || value.OverflowInt(ivalue.Int64()) {
+			return &RangeError{fullKey, origin.Source, rvalue, value.Type().String()}
+		}
+		value.SetInt(ivalue.Int64())
+	default:
+		if !ivalue.IsUint64() || value.OverflowUint(ivalue.Uint64()) {
+			return &RangeError{fullKey, origin.Source, rvalue, value.Type().String()}
+		}
+		value.SetUint(ivalue.Uint64())
+	}
+	return nil
+}
+
+// fieldError returns an error that prevented a field from being filled, ignoring errors of keys
+// that do not exist
+func fieldError(err error) error {
+	if _, ok := err.(*KeyNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// defaultsConfigSource holds default values of Bundle fields, given with default tag. It has the
+// lowest priority, so default values are only used when no other configuration source holds the
+// key.
+type defaultsConfigSource struct {
+	values map[string]interface{}
+}
+
+// withDefaults returns a copy of util, which also looks up given default values
+func withDefaults(util Util, defaults map[string]interface{}) Util {
+	sources := make([]ConfigSource, 0, len(util.configSources)+1)
+	sources = append(sources, util.configSources...)
+	// sources are sorted by ordinals and defaults have the lowest one
+	util.configSources = append(sources, defaultsConfigSource{defaults})
+	return util
+}
+
+func (c defaultsConfigSource) Get(key string) interface{} {
+	if val, ok := c.values[key]; ok {
+		return val
+	}
+	return nil
+}
+
+func (c defaultsConfigSource) Subscribe(ctx context.Context, key string, callback func(event ChangeEvent)) {
+	return
+}
+
+func (c defaultsConfigSource) Name() string {
+	return "default"
+}
+
+func (c defaultsConfigSource) Ordinal() int {
+	return math.MinInt32
+}
@@ -0,0 +1,205 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// subscriptionRegistry keeps callbacks of all watches on a configuration source, so that they can
+// be served by a single watch loop instead of one loop per key. The loop is started with the first
+// subscription and stopped when the last one is canceled.
+type subscriptionRegistry struct {
+	mu            sync.Mutex
+	nextID        int
+	subscriptions map[int]registeredSubscription
+	// cancel stops the watch loop, it is nil while the loop is not running
+	cancel context.CancelFunc
+}
+
+type registeredSubscription struct {
+	key string
+	// prefix subscriptions match all keys nested under key
+	prefix   bool
+	callback func(event ChangeEvent)
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{
+		subscriptions: make(map[int]registeredSubscription),
+	}
+}
+
+// add registers a callback for changes of a key (or keys nested under it, if prefix is true) until
+// ctx is done. If the watch loop is not running yet, add returns a context for it and true, and the
+// caller is responsible for starting the loop, which should run until the returned context is done.
+func (r *subscriptionRegistry) add(ctx context.Context, key string, prefix bool, callback func(event ChangeEvent)) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := r.nextID
+	r.nextID++
+	r.subscriptions[id] = registeredSubscription{key: key, prefix: prefix, callback: callback}
+
+	go func() {
+		<-ctx.Done()
+		r.remove(id)
+	}()
+
+	if r.cancel != nil {
+		return nil, false
+	}
+	loopCtx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	return loopCtx, true
+}
+
+// remove unregisters a callback and stops the watch loop if no callbacks are left
+func (r *subscriptionRegistry) remove(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.subscriptions, id)
+	if len(r.subscriptions) == 0 && r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+// keys returns distinct keys of all subscriptions that are not prefix subscriptions
+func (r *subscriptionRegistry) keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, s := range r.subscriptions {
+		if !s.prefix && !seen[s.key] {
+			seen[s.key] = true
+			keys = append(keys, s.key)
+		}
+	}
+	return keys
+}
+
+// dispatch calls callbacks of all subscriptions on the changed key or its prefixes. Subscriptions
+// on a list also match its elements (i.e. key[0]). Callbacks are called outside of the lock, so
+// they are free to subscribe or unsubscribe.
+func (r *subscriptionRegistry) dispatch(event ChangeEvent) {
+	r.mu.Lock()
+	var matched []registeredSubscription
+	for _, s := range r.subscriptions {
+		if isKeyOrElement(event.Key, s.key) || (s.prefix && hasKeyPrefix(event.Key, s.key)) {
+			matched = append(matched, s)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, s := range matched {
+		s.callback(event)
+	}
+}
+
+// effectiveWatch filters changes reported by configuration sources, so that callback is only fired
+// when the effective value of a key (i.e. the value returned by Util.Get) changes. Changes of
+// values that are shadowed by configuration sources with higher priority are dropped.
+type effectiveWatch struct {
+	mu       sync.Mutex
+	util     Util
+	values   map[string]interface{}
+	callback func(event ChangeEvent)
+}
+
+// newEffectiveWatch creates a filter for callback, remembering current effective values of given
+// (absolute) keys
+func newEffectiveWatch(c Util, keys []string, callback func(event ChangeEvent)) *effectiveWatch {
+	// keys of events are absolute
+	c.prefix = ""
+
+	w := &effectiveWatch{
+		util:     c,
+		values:   make(map[string]interface{}),
+		callback: callback,
+	}
+	for _, key := range keys {
+		if val, _, err := c.lookup(key); err == nil {
+			w.values[key] = val
+		}
+	}
+	return w
+}
+
+// changed recomputes the effective value of a changed key and fires callback if it differs from
+// the previous one. Reported event holds the configuration source that supplies the new value.
+// If the changed key is not tracked, but keys nested under it are (i.e. a directory was deleted in
+// etcd, which is reported by a single event), all of them are recomputed.
+func (w *effectiveWatch) changed(event ChangeEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	keys := []string{event.Key}
+	if _, tracked := w.values[event.Key]; !tracked {
+		var nested []string
+		for key := range w.values {
+			if key != event.Key && hasKeyPrefix(key, event.Key) {
+				nested = append(nested, key)
+			}
+		}
+		sort.Strings(nested)
+		keys = append(keys, nested...)
+	}
+
+	for _, key := range keys {
+		if !w.resolve(key, event) {
+			return
+		}
+	}
+}
+
+// resolve recomputes the effective value of a key, after event has been reported for it or for one
+// of its prefixes, and fires callback if the value changed. It returns false if the value could
+// not be recomputed.
+func (w *effectiveWatch) resolve(key string, event ChangeEvent) bool {
+	newValue, origin, err := w.util.lookup(key)
+	if _, ok := err.(*SourceUnavailableError); ok {
+		// effective value is unknown, wait for the next change
+		w.util.logger.Warning("Could not resolve changed value: %v", err)
+		return false
+	}
+
+	oldValue := w.values[key]
+	if reflect.DeepEqual(oldValue, newValue) {
+		return true
+	}
+
+	if newValue == nil {
+		delete(w.values, key)
+		w.callback(newChangeEvent(key, oldValue, nil, event.Source, event.Index))
+		return true
+	}
+	w.values[key] = newValue
+	w.callback(newChangeEvent(key, oldValue, newValue, origin.Source, event.Index))
+	return true
+}
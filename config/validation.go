@@ -0,0 +1,175 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateField checks a field value against the rules of field's validate tag (i.e.
+// validate:"min=1,max=100") and returns a *ValidationError for the first rule it violates. Rules
+// that are not known or have invalid parameters are reported as errors as well. Bare numbers in
+// limits of durations are interpreted in durationUnit, same as configuration values.
+func validateField(key string, value reflect.Value, rules string, durationUnit time.Duration) error {
+	for _, rule := range splitRules(rules) {
+		name, param := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, param = rule[:i], rule[i+1:]
+		}
+
+		ok, err := checkRule(value, name, param, durationUnit)
+		if err != nil {
+			return fmt.Errorf("config: invalid validation rule %s of key %s: %v", rule, key, err)
+		}
+		if !ok {
+			return &ValidationError{key, valueInterface(value), rule}
+		}
+	}
+	return nil
+}
+
+// splitRules splits rules of a validate tag by commas. Since regular expressions may contain
+// commas, regexp rule takes the rest of the tag and has to be the last rule.
+func splitRules(rules string) []string {
+	var split []string
+	for rules != "" {
+		i := strings.Index(rules, ",")
+		if strings.HasPrefix(strings.TrimSpace(rules), "regexp=") || i < 0 {
+			i = len(rules)
+		}
+		if rule := strings.TrimSpace(rules[:i]); rule != "" {
+			split = append(split, rule)
+		}
+		if i == len(rules) {
+			break
+		}
+		rules = rules[i+1:]
+	}
+	return split
+}
+
+// checkRule reports whether value satisfies a single validation rule
+func checkRule(value reflect.Value, name, param string, durationUnit time.Duration) (bool, error) {
+	switch name {
+	case "min", "max":
+		cmp, err := compareWithLimit(value, param, durationUnit)
+		if err != nil {
+			return false, err
+		}
+		if name == "min" {
+			return cmp >= 0, nil
+		}
+		return cmp <= 0, nil
+	case "oneof":
+		svalue := ruleText(value)
+		for _, option := range strings.Fields(param) {
+			if svalue == option {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "regexp":
+		re, err := regexp.Compile(param)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(ruleText(value)), nil
+	case "url":
+		u, err := url.Parse(ruleText(value))
+		return err == nil && u.Scheme != "" && u.Host != "", nil
+	case "hostport":
+		_, port, err := net.SplitHostPort(ruleText(value))
+		if err != nil {
+			return false, nil
+		}
+		_, err = strconv.ParseUint(port, 10, 16)
+		return err == nil, nil
+	default:
+		return false, fmt.Errorf("unknown rule")
+	}
+}
+
+// compareWithLimit compares value with the parameter of min or max rule and returns -1, 0 or 1.
+// Numbers are compared by their value, durations may also be limited with a duration (i.e.
+// max=1m, or a bare number in unit given by Options.DurationUnit), while strings and slices are
+// compared by their length.
+func compareWithLimit(value reflect.Value, param string, durationUnit time.Duration) (int, error) {
+	if value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+
+	var actual float64
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Type() == durationType {
+			limit, ok := convertDuration(param, durationUnit)
+			if !ok {
+				return 0, fmt.Errorf("%q is not a duration", param)
+			}
+			return compareFloats(float64(value.Int()), float64(limit)), nil
+		}
+		actual = float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		actual = float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		actual = value.Float()
+	case reflect.String, reflect.Slice:
+		actual = float64(value.Len())
+	default:
+		return 0, fmt.Errorf("not supported for type %s", value.Type())
+	}
+
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", param)
+	}
+	return compareFloats(actual, limit), nil
+}
+
+// ruleText returns the textual form of a value, which is checked by rules other than min and max.
+// Pointers are dereferenced, unless they implement fmt.Stringer (i.e. *url.URL).
+func ruleText(value reflect.Value) string {
+	if value.Kind() == reflect.Ptr && !value.IsNil() {
+		if stringer, ok := value.Interface().(fmt.Stringer); ok {
+			return stringer.String()
+		}
+		value = value.Elem()
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}